@@ -21,6 +21,7 @@ type Config struct {
 	TTLInstallations time.Duration
 	TTLOwnerMapping  time.Duration
 	TTLToken         time.Duration
+	TTLClockSkew     time.Duration
 	LockTimeout      time.Duration
 	LockPollInterval time.Duration
 }
@@ -48,6 +49,9 @@ func Configure(config Config) {
 	if cfg.TTLToken == 0 {
 		cfg.TTLToken = 10 * time.Minute
 	}
+	if cfg.TTLClockSkew == 0 {
+		cfg.TTLClockSkew = time.Hour
+	}
 	if cfg.LockTimeout == 0 {
 		cfg.LockTimeout = 30 * time.Second
 	}
@@ -72,7 +76,21 @@ func TTLToken() time.Duration {
 	return cfg.TTLToken
 }
 
+func TTLClockSkew() time.Duration {
+	return cfg.TTLClockSkew
+}
+
 func Get(key string, dest interface{}) (bool, error) {
+	return get(key, dest, false)
+}
+
+// GetStale is like Get, but also returns entries that have expired.
+// It is meant for revalidating expired data, e.g. with conditional requests.
+func GetStale(key string, dest interface{}) (bool, error) {
+	return get(key, dest, true)
+}
+
+func get(key string, dest interface{}, allowExpired bool) (bool, error) {
 	if !Enabled() {
 		return false, nil
 	}
@@ -97,7 +115,7 @@ func Get(key string, dest interface{}) (bool, error) {
 		logEvent("miss", key, keyHash, "key_mismatch")
 		return false, nil
 	}
-	if time.Now().After(entryData.ExpiresAt) {
+	if !allowExpired && time.Now().After(entryData.ExpiresAt) {
 		logEvent("miss", key, keyHash, "expired")
 		return false, nil
 	}
@@ -264,10 +282,10 @@ func logEvent(event, key, keyHash, details string) {
 	if details != "" {
 		message = fmt.Sprintf("%s details=%s", message, details)
 	}
-	logger.Filef(message)
+	logger.Filef("%s", message)
 	stderrMessage := fmt.Sprintf("cache %s key=%s", event, keyHash)
 	if details != "" {
 		stderrMessage = fmt.Sprintf("%s details=%s", stderrMessage, details)
 	}
-	logger.Stderrf(stderrMessage)
+	logger.Stderrf("%s", stderrMessage)
 }
@@ -1,8 +1,7 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +16,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
 	"github.com/plumber-cd/github-apps-trampoline/helper"
 	"github.com/plumber-cd/github-apps-trampoline/logger"
 )
@@ -24,32 +24,64 @@ import (
 var (
 	verbose bool
 
-	server         string
-	privateKey     string
-	appID          int
-	filter         string
-	currentRepo    bool
-	currentOwner   bool
-	repositories   string
-	repositoryIDs  string
-	permissions    string
-	installation   string
-	installationID int
+	server           string
+	api              string
+	privateKey       string
+	appID            int
+	clientID         string
+	filter           string
+	currentRepo      bool
+	currentOwner     bool
+	repositories     string
+	repositoryIDs    string
+	resolveRepos     bool
+	permissions      string
+	installation     string
+	installationID   int
+	installationType string
+
+	onPermissionMismatch string
+	preflight            bool
+	clampPermissions     bool
 
 	cliMode bool
 
+	onNoMatchMode  string
+	delegateHelper string
+
 	logFile          string
 	logTeeStderr     bool
 	tokenFingerprint bool
+	revokeOnErase    bool
 
 	cacheEnabled     bool
 	cacheDir         string
 	cacheTTLInstall  time.Duration
 	cacheTTLOwnerMap time.Duration
 	cacheTTLToken    time.Duration
+	cacheTTLSkew     time.Duration
 	cacheLockTimeout time.Duration
 	cacheLockPoll    time.Duration
 
+	jwtIATDrift time.Duration
+	jwtEXPDrift time.Duration
+
+	timeout     time.Duration
+	httpTimeout time.Duration
+	userAgent   string
+	apiVersion  string
+
+	retryAttempts int
+	retryMaxWait  time.Duration
+
+	rateLimitWarnThreshold int
+
+	caFile             string
+	clientCert         string
+	clientKey          string
+	proxy              string
+	insecureSkipVerify bool
+
 	cfgFile string
 	cfg     string
 )
@@ -61,196 +93,288 @@ var rootCmd = &cobra.Command{
 				written in Go`,
 	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		logger.Refresh()
-		logger.Get().Println("hi")
-		if viper.GetBool("verbose") {
-			outData, err := json.MarshalIndent(viper.AllSettings(), "", "    ")
-			cobra.CheckErr(err)
-			logger.Get().Println(string(outData))
-		}
-		cache.Configure(cache.Config{
-			Enabled:          viper.GetBool("cache"),
-			Dir:              viper.GetString("cache-dir"),
-			TTLInstallations: viper.GetDuration("cache-ttl-installations"),
-			TTLOwnerMapping:  viper.GetDuration("cache-ttl-installation-map"),
-			TTLToken:         viper.GetDuration("cache-ttl-token"),
-			LockTimeout:      viper.GetDuration("cache-lock-timeout"),
-			LockPollInterval: viper.GetDuration("cache-lock-poll"),
-		})
-
-		if cfgFile := viper.GetString("config"); cfgFile != "" {
-			logger.Get().Printf("Reading config from file %s", cfgFile)
-			dat, err := os.ReadFile(cfgFile)
-			cobra.CheckErr(err)
-			cfg = string(dat)
-		} else if dat, present := os.LookupEnv("GITHUB_APPS_TRAMPOLINE"); present {
-			logger.Get().Println("Reading config from environment")
-			cfg = dat
-		}
+		ctx, cancel, _helper := setup(cmd)
+		defer cancel()
 
-		if cfg == "" {
-			logger.Get().Println("Config was not set - inferring in-memory from cli args")
+		if cliMode = viper.GetBool("cli"); !cliMode {
+			logger.Get().Println("Git AskPass Credentials Helper mode enabled")
 
-			key := viper.GetString("key")
-			if key == "" {
-				cobra.CheckErr(errors.New("If no config was provided, must specify private key via --key or GITHUB_APPS_TRAMPOLINE_KEY"))
+			if len(args) != 1 || (args[0] != "get" && args[0] != "store" && args[0] != "erase") {
+				logger.Get().Printf("Expecting single arg 'get', 'store' or 'erase', got: %v", args)
+				logger.Get().Println("Silently exiting - nothing to do")
+				os.Exit(0)
 			}
+			action := args[0]
 
-			app := viper.GetInt("app")
-			if app <= 0 {
-				cobra.CheckErr(errors.New("If no config was provided, must specify app ID via --app or GITHUB_APPS_TRAMPOLINE_APP"))
+			in, raw := readGitInput()
+			if in["protocol"] != "https" {
+				checkNoMatchErr(ctx, &helper.SilentExitError{Err: fmt.Errorf("Expecting protocol 'https', got: %q", in["protocol"])}, action, raw)
 			}
 
-			filter := viper.GetString("filter")
-			if filter == "" {
-				logger.Get().Println("Filter was not set - assuming '.*'")
-				filter = ".*"
-			}
+			repoPath := fmt.Sprintf("%s/%s", in["host"], strings.TrimSuffix(in["path"], ".git"))
+			git, err := _helper.GitCredentialHelper(repoPath, raw)
+			checkNoMatchErr(ctx, err, action, raw)
 
-			config := helper.Config{
-				PrivateKey: key,
-				AppID:      app,
+			if action != "get" {
+				// The credential git stores or erases came from the delegate, if the rule delegated the request.
+				delegated, err := git.Relay(ctx, action, os.Stdout, os.Stderr)
+				checkNoMatchErr(ctx, err, action, raw)
+				if delegated {
+					return
+				}
 			}
 
-			if server := viper.GetString("server"); server != "" {
-				config.GitHubServer = &server
+			if action == "store" {
+				logger.Get().Println("Nothing to store - tokens are cached by the helper itself")
+				return
 			}
 
-			if api := viper.GetString("api"); api != "" {
-				config.GitHubAPI = &api
+			if action == "erase" {
+				if in["password"] == "" {
+					logger.Get().Println("Nothing to erase")
+					return
+				}
+				cached, err := git.EvictToken(in["password"])
+				if err != nil {
+					logger.Get().Printf("Failed to evict erased token: %s", err)
+				}
+				// The cached token is shared by every process using the same rule - only revoke it when asked to,
+				// and only if it is known to be issued by the trampoline, as git erases credentials of other helpers too.
+				if viper.GetBool("revoke-on-erase") {
+					if !cached {
+						logger.Get().Printf("Not revoking token %s - it is not in the cache of tokens issued by the helper", helper.Fingerprint(in["password"])[:12])
+						return
+					}
+					if err := git.RevokeToken(ctx, in["password"]); err != nil {
+						logger.Get().Printf("Failed to revoke erased token: %s", err)
+					}
+				}
+				return
 			}
 
-			if currentRepo := viper.GetBool("current-repo"); currentRepo {
-				logger.Get().Println("Enabled: current-repo")
-				config.CurrentRepositoryOnly = &currentRepo
-			}
-			if currentOwner := viper.GetBool("current-owner"); currentOwner {
-				logger.Get().Println("Enabled: current-owner")
-				config.CurrentOwnerOnly = &currentOwner
+			token, err := git.GetToken(ctx)
+			var delegated *helper.DelegatedError
+			if errors.As(err, &delegated) {
+				logger.Get().Printf("%s", delegated)
+				_, err := os.Stdout.Write(delegated.Output)
+				cobra.CheckErr(err)
+				return
 			}
+			checkNoMatchErr(ctx, err, action, raw)
 
-			if repositories := viper.GetString("repositories"); repositories != "" {
-				logger.Get().Println("Enabled: repositories")
-				split := strings.Split(repositories, ",")
-				logger.Get().Printf("Repositories: %v", split)
-				config.Repositories = &split
+			if viper.GetBool("token-fingerprint") {
+				logger.Get().Printf("Correlation: time=%s repo=%s token_fp=%s", time.Now().UTC().Format(time.RFC3339Nano), repoPath, helper.Fingerprint(token.Token)[:12])
 			}
 
-			if repositoryIDs := viper.GetString("repository-ids"); repositoryIDs != "" {
-				logger.Get().Println("Enabled: repository-ids")
-				ids := strings.Split(repositoryIDs, ",")
-				int_ids := make([]int, len(ids))
-				for i, id := range ids {
-					int_id, err := strconv.Atoi(id)
-					cobra.CheckErr(err)
-					int_ids[i] = int_id
-				}
-				logger.Get().Printf("Repository IDs: %v", int_ids)
-				config.RepositoryIDs = &int_ids
+			logger.Filef("Returning token in a helper format: %q", token.Token)
+			logger.Stderrf("Returning token in a helper format: [redacted]")
+			fmt.Printf("username=%s\n", "x-access-token")
+			fmt.Printf("password=%s\n", token.Token)
+			if !token.ExpiresAt.IsZero() {
+				fmt.Printf("password_expiry_utc=%d\n", token.ExpiresAt.Unix())
 			}
+		} else {
+			logger.Get().Println("Standalone CLI mode enabled")
 
-			if permissions := viper.GetString("permissions"); permissions != "" {
-				logger.Get().Println("Enabled: permissions")
-				raw := json.RawMessage(permissions)
-				logger.Get().Printf("Permissions: %s", string(raw))
-				config.Permissions = &raw
-			}
+			cli, err := _helper.CLIHelper()
+			checkCLIErr(err)
 
-			if installation := viper.GetString("installation"); installation != "" {
-				logger.Get().Printf("Enabled: installation %q", installation)
-				config.Installation = &installation
-			}
+			token, err := cli.GetToken(ctx)
+			checkCLINoMatchErr(ctx, cli, err)
 
-			if installationID := viper.GetInt("installation-id"); installationID > 0 {
-				logger.Get().Printf("Enabled: installation-id %q", installation)
-				config.InstallationID = &installationID
+			logger.Filef("Returning token in JSON format: %q", token.Token)
+			logger.Stderrf("Returning token in JSON format: [redacted]")
+			out := map[string]interface{}{
+				"username":             "x-access-token",
+				"password":             token.Token,
+				"permissions":          token.Permissions,
+				"repository_selection": token.RepositorySelection,
+				"repositories":         token.Repositories,
+			}
+			if !token.ExpiresAt.IsZero() {
+				out["expires_at"] = token.ExpiresAt
 			}
+			outData, err := json.MarshalIndent(out, "", "    ")
+			cobra.CheckErr(err)
+			fmt.Println(string(outData))
+		}
+	},
+}
+
+// setup configures logging, cache and helper from flags, and loads the rules config.
+func setup(cmd *cobra.Command) (context.Context, context.CancelFunc, *helper.Helper) {
+	logger.Refresh()
+	logger.Get().Println("hi")
+	if viper.GetBool("verbose") {
+		outData, err := json.MarshalIndent(viper.AllSettings(), "", "    ")
+		cobra.CheckErr(err)
+		logger.Get().Println(string(outData))
+	}
+	cache.Configure(cache.Config{
+		Enabled:          viper.GetBool("cache"),
+		Dir:              viper.GetString("cache-dir"),
+		TTLInstallations: viper.GetDuration("cache-ttl-installations"),
+		TTLOwnerMapping:  viper.GetDuration("cache-ttl-installation-map"),
+		TTLToken:         viper.GetDuration("cache-ttl-token"),
+		TTLClockSkew:     viper.GetDuration("cache-ttl-clock-skew"),
+		LockTimeout:      viper.GetDuration("cache-lock-timeout"),
+		LockPollInterval: viper.GetDuration("cache-lock-poll"),
+	})
+	iatDrift := viper.GetDuration("jwt-iat-drift")
+	expDrift := viper.GetDuration("jwt-exp-drift")
+	helper.Configure(helper.Options{
+		JWTIssuedAtDrift:   &iatDrift,
+		JWTExpirationDrift: &expDrift,
+		HTTPTimeout:        viper.GetDuration("http-timeout"),
+		UserAgent:          viper.GetString("user-agent"),
+		APIVersion:         viper.GetString("api-version"),
+		Retry: github.RetryPolicy{
+			MaxAttempts: viper.GetInt("retry-attempts"),
+			MaxWait:     viper.GetDuration("retry-max-wait"),
+		},
+		Transport: github.TransportOptions{
+			CAFile:             viper.GetString("ca-file"),
+			ClientCert:         viper.GetString("client-cert"),
+			ClientKey:          viper.GetString("client-key"),
+			Proxy:              viper.GetString("proxy"),
+			InsecureSkipVerify: viper.GetBool("insecure-skip-verify"),
+		},
+		RateLimitWarnThreshold: viper.GetInt("rate-limit-warn-threshold"),
+	})
+
+	if cfgFile := viper.GetString("config"); cfgFile != "" {
+		logger.Get().Printf("Reading config from file %s", cfgFile)
+		dat, err := os.ReadFile(cfgFile)
+		cobra.CheckErr(err)
+		cfg = string(dat)
+	} else if dat, present := os.LookupEnv("GITHUB_APPS_TRAMPOLINE"); present {
+		logger.Get().Println("Reading config from environment")
+		cfg = dat
+	}
 
-			obj := map[string]helper.Config{}
-			obj[filter] = config
+	if cfg == "" {
+		logger.Get().Println("Config was not set - inferring in-memory from cli args")
 
-			jsonData, err := json.MarshalIndent(obj, "", "    ")
-			cobra.CheckErr(err)
-			cfg = string(jsonData)
+		key := viper.GetString("key")
+		if key == "" {
+			cobra.CheckErr(errors.New("If no config was provided, must specify private key via --key or GITHUB_APPS_TRAMPOLINE_KEY"))
 		}
 
-		logger.Get().Printf("Config: %s", cfg)
-		_helper := helper.New(cfg)
+		app := viper.GetInt("app")
+		clientID := viper.GetString("client-id")
+		if app <= 0 && clientID == "" {
+			cobra.CheckErr(errors.New("If no config was provided, must specify app ID via --app or GITHUB_APPS_TRAMPOLINE_APP, or client ID via --client-id or GITHUB_APPS_TRAMPOLINE_CLIENT_ID"))
+		}
 
-		if cliMode = viper.GetBool("cli"); !cliMode {
-			logger.Get().Println("Git AskPass Credentials Helper mode enabled")
+		filter := viper.GetString("filter")
+		if filter == "" {
+			logger.Get().Println("Filter was not set - assuming '.*'")
+			filter = ".*"
+		}
 
-			if len(args) != 1 || args[0] != "get" {
-				logger.Get().Printf("Expecting single arg 'get', got: %v", args)
-				logger.Get().Println("Silently exiting - nothing to do")
-				os.Exit(0)
-			}
+		config := helper.Config{
+			PrivateKey: key,
+			AppID:      app,
+			ClientID:   clientID,
+		}
 
-			inBytes, err := io.ReadAll(os.Stdin)
-			cobra.CheckErr(err)
-			in := string(inBytes)
-			logger.Get().Printf("Read input from git:\n%s", in)
-
-			var protocol, host, path string
-
-			re := regexp.MustCompile("(protocol|host|path)=(.*)")
-			result := re.FindAllStringSubmatchIndex(in, -1)
-			for _, match := range result {
-				key := in[match[2]:match[3]]
-				value := in[match[4]:match[5]]
-				switch key {
-				case "protocol":
-					protocol = value
-				case "host":
-					host = value
-				case "path":
-					path = strings.TrimSuffix(value, ".git")
-				}
-			}
+		if server := viper.GetString("server"); server != "" {
+			config.GitHubServer = &server
+		}
 
-			if protocol != "https" {
-				logger.Get().Printf("Expecting protocol 'https', got: %q", protocol)
-				logger.Get().Println("Silently exiting - nothing to do")
-				os.Exit(0)
-			}
+		if api := viper.GetString("api"); api != "" {
+			config.GitHubAPI = &api
+		}
 
-			repoPath := fmt.Sprintf("%s/%s", host, path)
-			git, err := _helper.GitHelper(repoPath)
-			checkSilentErr(err)
+		if currentRepo := viper.GetBool("current-repo"); currentRepo {
+			logger.Get().Println("Enabled: current-repo")
+			config.CurrentRepositoryOnly = &currentRepo
+		}
+		if currentOwner := viper.GetBool("current-owner"); currentOwner {
+			logger.Get().Println("Enabled: current-owner")
+			config.CurrentOwnerOnly = &currentOwner
+		}
 
-			token, err := git.GetToken()
-			checkSilentErr(err)
+		if repositories := viper.GetString("repositories"); repositories != "" {
+			logger.Get().Println("Enabled: repositories")
+			split := strings.Split(repositories, ",")
+			logger.Get().Printf("Repositories: %v", split)
+			config.Repositories = &split
+		}
 
-			if viper.GetBool("token-fingerprint") {
-				fp := sha256.Sum256([]byte(token))
-				fingerprint := hex.EncodeToString(fp[:])
-				logger.Get().Printf("Correlation: time=%s repo=%s token_fp=%s", time.Now().UTC().Format(time.RFC3339Nano), repoPath, fingerprint[:12])
+		if repositoryIDs := viper.GetString("repository-ids"); repositoryIDs != "" {
+			logger.Get().Println("Enabled: repository-ids")
+			ids := strings.Split(repositoryIDs, ",")
+			int_ids := make([]int, len(ids))
+			for i, id := range ids {
+				int_id, err := strconv.Atoi(id)
+				cobra.CheckErr(err)
+				int_ids[i] = int_id
 			}
+			logger.Get().Printf("Repository IDs: %v", int_ids)
+			config.RepositoryIDs = &int_ids
+		}
 
-			logger.Filef("Returning token in a helper format: %q", token)
-			logger.Stderrf("Returning token in a helper format: [redacted]")
-			fmt.Printf("username=%s\n", "x-access-token")
-			fmt.Printf("password=%s\n", token)
-		} else {
-			logger.Get().Println("Standalone CLI mode enabled")
+		if resolveRepositories := viper.GetBool("resolve-repositories"); resolveRepositories {
+			logger.Get().Println("Enabled: resolve-repositories")
+			config.ResolveRepositories = &resolveRepositories
+		}
 
-			cli, err := _helper.CLIHelper()
-			cobra.CheckErr(err)
+		if permissions := viper.GetString("permissions"); permissions != "" {
+			logger.Get().Println("Enabled: permissions")
+			raw := json.RawMessage(permissions)
+			logger.Get().Printf("Permissions: %s", string(raw))
+			config.Permissions = &raw
+		}
 
-			token, err := cli.GetToken()
-			cobra.CheckErr(err)
+		if installation := viper.GetString("installation"); installation != "" {
+			logger.Get().Printf("Enabled: installation %q", installation)
+			config.Installation = &installation
+		}
 
-			logger.Filef("Returning token in JSON format: %q", token)
-			logger.Stderrf("Returning token in JSON format: [redacted]")
-			out := map[string]string{
-				"username": "x-access-token",
-				"password": token,
-			}
-			outData, err := json.MarshalIndent(out, "", "    ")
-			cobra.CheckErr(err)
-			fmt.Println(string(outData))
+		if installationType := viper.GetString("installation-type"); installationType != "" {
+			logger.Get().Printf("Enabled: installation-type %q", installationType)
+			config.InstallationType = &installationType
 		}
-	},
+
+		if preflight := viper.GetBool("preflight"); preflight {
+			logger.Get().Println("Enabled: preflight")
+			config.Preflight = &preflight
+		}
+
+		if clampPermissions := viper.GetBool("clamp-permissions"); clampPermissions {
+			logger.Get().Println("Enabled: clamp-permissions")
+			config.ClampPermissions = &clampPermissions
+		}
+
+		if onPermissionMismatch := viper.GetString("on-permission-mismatch"); onPermissionMismatch != "" {
+			logger.Get().Printf("Enabled: on-permission-mismatch %q", onPermissionMismatch)
+			config.OnPermissionMismatch = &onPermissionMismatch
+		}
+
+		if installationID := viper.GetInt("installation-id"); installationID > 0 {
+			logger.Get().Printf("Enabled: installation-id %q", installation)
+			config.InstallationID = &installationID
+		}
+
+		obj := map[string]helper.Config{}
+		obj[filter] = config
+
+		jsonData, err := json.MarshalIndent(obj, "", "    ")
+		cobra.CheckErr(err)
+		cfg = string(jsonData)
+	}
+
+	logger.Get().Printf("Config: %s", cfg)
+	_helper := helper.New(cfg)
+
+	if timeout := viper.GetDuration("timeout"); timeout > 0 {
+		ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+		return ctx, cancel, _helper
+	}
+	ctx, cancel := context.WithCancel(cmd.Context())
+
+	return ctx, cancel, _helper
 }
 
 func Execute() {
@@ -272,6 +396,16 @@ func init() {
 		cobra.CheckErr(err)
 	}
 
+	rootCmd.PersistentFlags().StringVar(&onNoMatchMode, "on-no-match", "", "what to do when no rule matched or no installation was found: silent, fail or delegate (default silent in git helper mode, fail in --cli mode)")
+	if err := viper.BindPFlag("on-no-match", rootCmd.PersistentFlags().Lookup("on-no-match")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&delegateHelper, "delegate-helper", "", "credential helper to delegate to with --on-no-match=delegate, as in git credential.helper (e.g. 'cache' or '!gh auth git-credential')")
+	if err := viper.BindPFlag("delegate-helper", rootCmd.PersistentFlags().Lookup("delegate-helper")); err != nil {
+		cobra.CheckErr(err)
+	}
+
 	rootCmd.PersistentFlags().BoolVar(&cliMode, "cli", false, "cli mode")
 	if err := viper.BindPFlag("cli", rootCmd.PersistentFlags().Lookup("cli")); err != nil {
 		cobra.CheckErr(err)
@@ -282,7 +416,7 @@ func init() {
 		cobra.CheckErr(err)
 	}
 
-	rootCmd.PersistentFlags().StringVar(&server, "api", "", "GitHub API url")
+	rootCmd.PersistentFlags().StringVar(&api, "api", "", "GitHub API url")
 	if err := viper.BindPFlag("api", rootCmd.PersistentFlags().Lookup("api")); err != nil {
 		cobra.CheckErr(err)
 	}
@@ -297,6 +431,11 @@ func init() {
 		cobra.CheckErr(err)
 	}
 
+	rootCmd.PersistentFlags().StringVar(&clientID, "client-id", "", "app client ID (used as JWT issuer instead of app ID)")
+	if err := viper.BindPFlag("client-id", rootCmd.PersistentFlags().Lookup("client-id")); err != nil {
+		cobra.CheckErr(err)
+	}
+
 	rootCmd.PersistentFlags().StringVarP(&filter, "filter", "f", "", "filter")
 	if err := viper.BindPFlag("filter", rootCmd.PersistentFlags().Lookup("filter")); err != nil {
 		cobra.CheckErr(err)
@@ -321,6 +460,11 @@ func init() {
 		cobra.CheckErr(err)
 	}
 
+	rootCmd.PersistentFlags().BoolVar(&resolveRepos, "resolve-repositories", false, "resolve repositories to IDs and check the installation has access to all of them before requesting a token")
+	if err := viper.BindPFlag("resolve-repositories", rootCmd.PersistentFlags().Lookup("resolve-repositories")); err != nil {
+		cobra.CheckErr(err)
+	}
+
 	rootCmd.PersistentFlags().StringVarP(&permissions, "permissions", "p", "", "permissions")
 	if err := viper.BindPFlag("permissions", rootCmd.PersistentFlags().Lookup("permissions")); err != nil {
 		cobra.CheckErr(err)
@@ -336,6 +480,26 @@ func init() {
 		cobra.CheckErr(err)
 	}
 
+	rootCmd.PersistentFlags().StringVar(&installationType, "installation-type", "", "installation type to look up: enterprise, organization or user")
+	if err := viper.BindPFlag("installation-type", rootCmd.PersistentFlags().Lookup("installation-type")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&preflight, "preflight", false, "check requested permissions against the installation before requesting a token")
+	if err := viper.BindPFlag("preflight", rootCmd.PersistentFlags().Lookup("preflight")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&clampPermissions, "clamp-permissions", false, "reduce requested permissions to what the installation has (implies --preflight)")
+	if err := viper.BindPFlag("clamp-permissions", rootCmd.PersistentFlags().Lookup("clamp-permissions")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&onPermissionMismatch, "on-permission-mismatch", "", "what to do when granted permissions or repositories differ from requested: ignore, warn or fail")
+	if err := viper.BindPFlag("on-permission-mismatch", rootCmd.PersistentFlags().Lookup("on-permission-mismatch")); err != nil {
+		cobra.CheckErr(err)
+	}
+
 	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "log file path")
 	if err := viper.BindPFlag("log-file", rootCmd.PersistentFlags().Lookup("log-file")); err != nil {
 		cobra.CheckErr(err)
@@ -351,6 +515,73 @@ func init() {
 		cobra.CheckErr(err)
 	}
 
+	rootCmd.PersistentFlags().BoolVar(&revokeOnErase, "revoke-on-erase", false, "also revoke tokens git erases, if they were issued by the helper and cached (requires --cache)")
+	if err := viper.BindPFlag("revoke-on-erase", rootCmd.PersistentFlags().Lookup("revoke-on-erase")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&jwtIATDrift, "jwt-iat-drift", time.Minute, "how far back to date the JWT iat claim to allow for clock drift")
+	if err := viper.BindPFlag("jwt-iat-drift", rootCmd.PersistentFlags().Lookup("jwt-iat-drift")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().DurationVar(&jwtEXPDrift, "jwt-exp-drift", time.Minute, "how much to shorten the 10 minutes JWT lifetime to allow for clock drift")
+	if err := viper.BindPFlag("jwt-exp-drift", rootCmd.PersistentFlags().Lookup("jwt-exp-drift")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "overall deadline for all GitHub API calls (0 for none)")
+	if err := viper.BindPFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().DurationVar(&httpTimeout, "http-timeout", 30*time.Second, "timeout for each individual GitHub API request")
+	if err := viper.BindPFlag("http-timeout", rootCmd.PersistentFlags().Lookup("http-timeout")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().StringVar(&userAgent, "user-agent", github.DefaultUserAgent, "User-Agent header for GitHub API requests")
+	if err := viper.BindPFlag("user-agent", rootCmd.PersistentFlags().Lookup("user-agent")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&apiVersion, "api-version", "", "GitHub REST API version to send in X-GitHub-Api-Version, or 'auto' to detect it via /meta (GHES compatibility)")
+	if err := viper.BindPFlag("api-version", rootCmd.PersistentFlags().Lookup("api-version")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&retryAttempts, "retry-attempts", 3, "total attempts for GitHub API calls failing with 5xx, network errors or rate limits")
+	if err := viper.BindPFlag("retry-attempts", rootCmd.PersistentFlags().Lookup("retry-attempts")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().DurationVar(&retryMaxWait, "retry-max-wait", time.Minute, "maximum wait before a single retry, including waits requested via Retry-After and X-RateLimit-Reset")
+	if err := viper.BindPFlag("retry-max-wait", rootCmd.PersistentFlags().Lookup("retry-max-wait")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&rateLimitWarnThreshold, "rate-limit-warn-threshold", 100, "warn when fewer GitHub API requests than this remain in the rate limit, 0 disables the warning")
+	if err := viper.BindPFlag("rate-limit-warn-threshold", rootCmd.PersistentFlags().Lookup("rate-limit-warn-threshold")); err != nil {
+		cobra.CheckErr(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&caFile, "ca-file", "", "PEM bundle to trust in addition to system roots for GitHub API")
+	if err := viper.BindPFlag("ca-file", rootCmd.PersistentFlags().Lookup("ca-file")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().StringVar(&clientCert, "client-cert", "", "PEM client certificate for mTLS to GitHub API")
+	if err := viper.BindPFlag("client-cert", rootCmd.PersistentFlags().Lookup("client-cert")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().StringVar(&clientKey, "client-key", "", "PEM key for the client certificate")
+	if err := viper.BindPFlag("client-key", rootCmd.PersistentFlags().Lookup("client-key")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "HTTP(S) proxy URL for GitHub API (default from HTTPS_PROXY/HTTP_PROXY/NO_PROXY)")
+	if err := viper.BindPFlag("proxy", rootCmd.PersistentFlags().Lookup("proxy")); err != nil {
+		cobra.CheckErr(err)
+	}
+	rootCmd.PersistentFlags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "disable TLS certificate verification for GitHub API (insecure)")
+	if err := viper.BindPFlag("insecure-skip-verify", rootCmd.PersistentFlags().Lookup("insecure-skip-verify")); err != nil {
+		cobra.CheckErr(err)
+	}
+
 	rootCmd.PersistentFlags().BoolVar(&cacheEnabled, "cache", false, "enable caching for installations and tokens")
 	if err := viper.BindPFlag("cache", rootCmd.PersistentFlags().Lookup("cache")); err != nil {
 		cobra.CheckErr(err)
@@ -371,6 +602,10 @@ func init() {
 	if err := viper.BindPFlag("cache-ttl-token", rootCmd.PersistentFlags().Lookup("cache-ttl-token")); err != nil {
 		cobra.CheckErr(err)
 	}
+	rootCmd.PersistentFlags().DurationVar(&cacheTTLSkew, "cache-ttl-clock-skew", 0, "cache TTL for detected clock skew against GitHub")
+	if err := viper.BindPFlag("cache-ttl-clock-skew", rootCmd.PersistentFlags().Lookup("cache-ttl-clock-skew")); err != nil {
+		cobra.CheckErr(err)
+	}
 	rootCmd.PersistentFlags().DurationVar(&cacheLockTimeout, "cache-lock-timeout", 0, "cache lock timeout")
 	if err := viper.BindPFlag("cache-lock-timeout", rootCmd.PersistentFlags().Lookup("cache-lock-timeout")); err != nil {
 		cobra.CheckErr(err)
@@ -392,13 +627,22 @@ func initConfig() {
 	}
 }
 
-func checkSilentErr(err error) {
-	if err != nil {
-		var s *helper.SilentExitError
-		if errors.As(err, &s) {
-			logger.Get().Printf("Silently exiting: %s", err)
-			os.Exit(0)
-		}
-		cobra.CheckErr(err)
+// readGitInput reads key=value pairs of the git credential helper protocol from stdin.
+func readGitInput() (map[string]string, []byte) {
+	inBytes, err := io.ReadAll(os.Stdin)
+	cobra.CheckErr(err)
+	in := string(inBytes)
+	logger.Filef("Read input from git:\n%s", in)
+	logger.Stderrf("Read input from git:\n%s", redactGitInput(in))
+
+	values := map[string]string{}
+	re := regexp.MustCompile("(?m)^(protocol|host|path|password)=(.*)$")
+	for _, match := range re.FindAllStringSubmatch(in, -1) {
+		values[match[1]] = strings.TrimSuffix(match[2], "\r")
 	}
+	return values, inBytes
+}
+
+func redactGitInput(in string) string {
+	return regexp.MustCompile("(?m)^password=.*$").ReplaceAllString(in, "password=[redacted]")
 }
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/helper"
+)
+
+// Exit codes used in --cli mode, so that scripts can react to a failure without parsing the message.
+const (
+	exitCodeError                         = 1
+	exitCodeBadCredentials                = 10
+	exitCodeClockSkew                     = 11
+	exitCodeInstallationSuspended         = 12
+	exitCodePermissionsExceedInstallation = 13
+	exitCodeRepositoryNotAccessible       = 14
+	exitCodeNotFound                      = 15
+	exitCodeRateLimited                   = 16
+	exitCodeServerError                   = 17
+	exitCodePermissionMismatch            = 20
+	exitCodeTimeout                       = 21
+)
+
+var exitCodes = map[github.ErrorKind]int{
+	github.ErrorKindBadCredentials:                exitCodeBadCredentials,
+	github.ErrorKindClockSkew:                     exitCodeClockSkew,
+	github.ErrorKindInstallationSuspended:         exitCodeInstallationSuspended,
+	github.ErrorKindPermissionsExceedInstallation: exitCodePermissionsExceedInstallation,
+	github.ErrorKindRepositoryNotAccessible:       exitCodeRepositoryNotAccessible,
+	github.ErrorKindNotFound:                      exitCodeNotFound,
+	github.ErrorKindRateLimited:                   exitCodeRateLimited,
+	github.ErrorKindServerError:                   exitCodeServerError,
+}
+
+func exitCode(err error) int {
+	var mismatchErr *helper.PermissionMismatchError
+	var installationPermissionsErr *helper.InstallationPermissionsError
+	var repositoriesErr *helper.RepositoriesNotAccessibleError
+	switch {
+	case errors.As(err, &mismatchErr):
+		return exitCodePermissionMismatch
+	case errors.As(err, &installationPermissionsErr):
+		return exitCodePermissionsExceedInstallation
+	case errors.As(err, &repositoriesErr):
+		return exitCodeRepositoryNotAccessible
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitCodeTimeout
+	}
+	if code, ok := exitCodes[github.Kind(err)]; ok {
+		return code
+	}
+	return exitCodeError
+}
+
+// checkCLIErr is like cobra.CheckErr, but exits with a code specific to the kind of error.
+func checkCLIErr(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitCode(err))
+	}
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	installationsRepo   string
+	installationsOutput string
+)
+
+func init() {
+	installationsCmd.PersistentFlags().StringVar(&installationsRepo, "repo", "", "repo path such as github.com/foo/bar to select the rule, by default config must contain exactly one rule")
+	installationsCmd.PersistentFlags().StringVarP(&installationsOutput, "output", "o", "table", "output format: table or json")
+	installationsCmd.AddCommand(installationsListCmd)
+	installationsCmd.AddCommand(installationsReposCmd)
+	rootCmd.AddCommand(installationsCmd)
+}
+
+var installationsCmd = &cobra.Command{
+	Use:   "installations",
+	Short: "List and inspect app installations",
+}
+
+var installationsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all installations of the app",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel, _helper := setup(cmd)
+		defer cancel()
+
+		installations, err := selectHelper(_helper, installationsRepo).Installations(ctx)
+		cobra.CheckErr(err)
+
+		if installationsOutput == "json" {
+			printJSON(installations)
+			return
+		}
+		checkTableOutput(installationsOutput)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tACCOUNT\tTYPE\tREPOSITORIES\tSUSPENDED\tPERMISSIONS")
+		for _, installation := range installations {
+			suspended := "no"
+			if installation.SuspendedAt != nil {
+				suspended = installation.SuspendedAt.UTC().Format("2006-01-02")
+			}
+			fmt.Fprintf(
+				w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+				installation.ID,
+				installation.Account.Handle(),
+				installation.TargetType,
+				installation.RepositorySelection,
+				suspended,
+				formatPermissions(installation.Permissions),
+			)
+		}
+		cobra.CheckErr(w.Flush())
+	},
+}
+
+var installationsReposCmd = &cobra.Command{
+	Use:   "repos <owner>",
+	Short: "List repositories accessible to the installation for the owner",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel, _helper := setup(cmd)
+		defer cancel()
+
+		repositories, err := selectHelper(_helper, installationsRepo).InstallationRepositories(ctx, args[0])
+		cobra.CheckErr(err)
+
+		if installationsOutput == "json" {
+			printJSON(repositories)
+			return
+		}
+		checkTableOutput(installationsOutput)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREPOSITORY\tPRIVATE")
+		for _, repository := range repositories {
+			fmt.Fprintf(w, "%d\t%s\t%t\n", repository.ID, repository.FullName, repository.Private)
+		}
+		cobra.CheckErr(w.Flush())
+	},
+}
+
+func printJSON(v interface{}) {
+	outData, err := json.MarshalIndent(v, "", "    ")
+	cobra.CheckErr(err)
+	fmt.Println(string(outData))
+}
+
+func checkTableOutput(output string) {
+	if output != "table" {
+		cobra.CheckErr(fmt.Errorf("Unknown output format %q, expected table or json", output))
+	}
+}
+
+func formatPermissions(permissions map[string]string) string {
+	names := make([]string, 0, len(permissions))
+	for name := range permissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, permissions[name]))
+	}
+	return strings.Join(pairs, ",")
+}
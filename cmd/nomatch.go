@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/github-apps-trampoline/helper"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// onNoMatch returns the on_no_match mode the rule chose, the configured on-no-match mode, or defaultMode if neither is set.
+func onNoMatch(defaultMode string, err *helper.SilentExitError) string {
+	if err.OnNoMatch != "" {
+		return err.OnNoMatch
+	}
+	mode := viper.GetString("on-no-match")
+	if mode == "" {
+		return defaultMode
+	}
+	switch mode {
+	case helper.OnNoMatchSilent, helper.OnNoMatchFail, helper.OnNoMatchDelegate:
+		return mode
+	}
+	cobra.CheckErr(fmt.Errorf("--on-no-match must be one of %s, %s or %s, got: %q", helper.OnNoMatchSilent, helper.OnNoMatchFail, helper.OnNoMatchDelegate, mode))
+	return ""
+}
+
+// checkNoMatchErr handles errors in git helper mode.
+// A request that no rule could serve is silently ignored by default, so git moves on to the next helper,
+// but can also fail or be delegated to another credential helper with the original input.
+func checkNoMatchErr(ctx context.Context, err error, action string, input []byte) {
+	if err == nil {
+		return
+	}
+	var s *helper.SilentExitError
+	if !errors.As(err, &s) {
+		cobra.CheckErr(err)
+	}
+
+	switch onNoMatch(helper.OnNoMatchSilent, s) {
+	case helper.OnNoMatchFail:
+		cobra.CheckErr(err)
+	case helper.OnNoMatchDelegate:
+		logger.Get().Printf("No match: %s", err)
+		cobra.CheckErr(helper.Delegate(ctx, viper.GetString("delegate-helper"), action, input, os.Stdout, os.Stderr))
+		os.Exit(0)
+	default:
+		logger.Get().Printf("Silently exiting: %s", err)
+		os.Exit(0)
+	}
+}
+
+// checkCLINoMatchErr handles errors in --cli mode, where a request that can't be served is an error by default.
+// When delegating, the credential helper is asked for the configured installation and its output is converted to JSON.
+func checkCLINoMatchErr(ctx context.Context, cli helper.IHelper, err error) {
+	if err == nil {
+		return
+	}
+	var delegated *helper.DelegatedError
+	if errors.As(err, &delegated) {
+		logger.Get().Printf("%s", delegated)
+		printDelegatedCredential(delegated.Output, err)
+	}
+	var s *helper.SilentExitError
+	if !errors.As(err, &s) {
+		checkCLIErr(err)
+	}
+
+	switch onNoMatch(helper.OnNoMatchFail, s) {
+	case helper.OnNoMatchSilent:
+		logger.Get().Printf("Silently exiting: %s", err)
+		os.Exit(0)
+	case helper.OnNoMatchDelegate:
+		logger.Get().Printf("No match: %s", err)
+		out := bytes.Buffer{}
+		checkCLIErr(helper.Delegate(ctx, viper.GetString("delegate-helper"), "get", cli.CredentialInput(), &out, os.Stderr))
+		printDelegatedCredential(out.Bytes(), err)
+	default:
+		checkCLIErr(err)
+	}
+}
+
+// printDelegatedCredential converts credential helper output to the JSON format of --cli mode and exits.
+func printDelegatedCredential(output []byte, err error) {
+	credential := helper.ParseCredential(output)
+	if credential["password"] == "" {
+		checkCLIErr(fmt.Errorf("delegated credential helper returned no password: %w", err))
+	}
+	result := map[string]interface{}{
+		"username": credential["username"],
+		"password": credential["password"],
+	}
+	if expiry, err := strconv.ParseInt(credential["password_expiry_utc"], 10, 64); err == nil {
+		result["expires_at"] = time.Unix(expiry, 0).UTC()
+	}
+	outData, err := json.MarshalIndent(result, "", "    ")
+	cobra.CheckErr(err)
+	fmt.Println(string(outData))
+	os.Exit(0)
+}
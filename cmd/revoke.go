@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/github-apps-trampoline/helper"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+var (
+	revokeToken string
+	revokeRepo  string
+)
+
+func init() {
+	revokeCmd.Flags().StringVar(&revokeToken, "token", "", "token to revoke, read from stdin if not set and stdin is piped")
+	revokeCmd.Flags().StringVar(&revokeRepo, "repo", "", "repo path such as github.com/foo/bar - selects the rule and, without --token or piped stdin, revokes the cached token for it")
+	rootCmd.AddCommand(revokeCmd)
+}
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke an installation token",
+	Long: `Revokes an installation token via DELETE /installation/token.
+The token is given via --token, piped stdin (raw or in git credential format),
+or looked up in the cache for --repo - in that order. Revoked tokens are never served from cache again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel, _helper := setup(cmd)
+		defer cancel()
+
+		h := selectHelper(_helper, revokeRepo)
+		token := resolveToken(h, revokeToken, revokeRepo)
+
+		cobra.CheckErr(h.RevokeToken(ctx, token))
+		fmt.Printf("Revoked token %s\n", helper.Fingerprint(token)[:12])
+	},
+}
+
+// selectHelper picks the rule matching repo, or the only rule in config if repo is empty.
+func selectHelper(_helper *helper.Helper, repo string) helper.IHelper {
+	if repo != "" {
+		git, err := _helper.GitHelper(repo)
+		cobra.CheckErr(err)
+		return git
+	}
+	cli, err := _helper.CLIHelper()
+	cobra.CheckErr(err)
+	return cli
+}
+
+// resolveToken returns the token given explicitly, piped to stdin, or cached for the repo - in that order.
+func resolveToken(h helper.IHelper, token, repo string) string {
+	if token == "" && stdinPiped() {
+		token = readTokenFromStdin()
+	}
+	if token == "" && repo != "" {
+		cached, err := h.CachedToken()
+		cobra.CheckErr(err)
+		if cached == nil {
+			cobra.CheckErr(fmt.Errorf("No cached token found for %s", repo))
+		}
+		token = cached.Token
+	}
+	if token == "" {
+		cobra.CheckErr(errors.New("No token given - use --token, --repo or stdin"))
+	}
+	return token
+}
+
+// stdinPiped reports whether stdin is a pipe or a file, as opposed to a terminal or /dev/null.
+func stdinPiped() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&(os.ModeNamedPipe|os.ModeCharDevice) == os.ModeNamedPipe || stat.Mode().IsRegular()
+}
+
+// readTokenFromStdin accepts either a raw token or git credential format with a password= line.
+func readTokenFromStdin() string {
+	inBytes, err := io.ReadAll(os.Stdin)
+	cobra.CheckErr(err)
+	in := strings.TrimSpace(string(inBytes))
+	for _, line := range strings.Split(in, "\n") {
+		if password, ok := strings.CutPrefix(strings.TrimSpace(line), "password="); ok {
+			return password
+		}
+	}
+	logger.Get().Println("Read raw token from stdin")
+	return in
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectToken  string
+	inspectRepo   string
+	inspectOutput string
+)
+
+func init() {
+	tokenInspectCmd.Flags().StringVar(&inspectToken, "token", "", "token to inspect, read from stdin if not set and stdin is piped")
+	tokenInspectCmd.Flags().StringVar(&inspectRepo, "repo", "", "repo path such as github.com/foo/bar - selects the rule and, without --token or piped stdin, inspects the cached token for it")
+	tokenInspectCmd.Flags().StringVarP(&inspectOutput, "output", "o", "table", "output format: table or json")
+	tokenCmd.AddCommand(tokenInspectCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Work with installation tokens",
+}
+
+var tokenInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Report what an installation token can do",
+	Long: `Reports fingerprint, expiry, permissions, accessible repositories and rate limit status of a token.
+The token itself is never printed. Permissions are only known for tokens issued by this helper with caching enabled.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel, _helper := setup(cmd)
+		defer cancel()
+
+		h := selectHelper(_helper, inspectRepo)
+		token := resolveToken(h, inspectToken, inspectRepo)
+
+		info, err := h.InspectToken(ctx, token)
+		cobra.CheckErr(err)
+
+		if inspectOutput == "json" {
+			printJSON(info)
+			return
+		}
+		checkTableOutput(inspectOutput)
+
+		expiresAt := "unknown"
+		if info.ExpiresAt != nil {
+			expiresAt = fmt.Sprintf("%s (in %s)", info.ExpiresAt.UTC().Format(time.RFC3339), time.Until(*info.ExpiresAt).Truncate(time.Second))
+		}
+		permissions := "unknown"
+		if info.Permissions != nil {
+			permissions = formatPermissions(info.Permissions)
+		}
+		rateLimit := "unknown"
+		if info.RateLimit != nil {
+			rateLimit = fmt.Sprintf(
+				"%d/%d remaining, resets at %s",
+				info.RateLimit.Remaining, info.RateLimit.Limit, time.Unix(info.RateLimit.Reset, 0).UTC().Format(time.RFC3339),
+			)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Fingerprint:\t%s\n", info.Fingerprint[:12])
+		fmt.Fprintf(w, "Expires:\t%s\n", expiresAt)
+		fmt.Fprintf(w, "Valid:\t%t\n", info.Valid)
+		fmt.Fprintf(w, "Revoked:\t%t\n", info.Revoked)
+		fmt.Fprintf(w, "Permissions:\t%s\n", permissions)
+		if info.RepositorySelection != "" {
+			fmt.Fprintf(w, "Repository selection:\t%s\n", info.RepositorySelection)
+		}
+		fmt.Fprintf(w, "Rate limit:\t%s\n", rateLimit)
+		fmt.Fprintf(w, "Repositories:\t%d\n", len(info.Repositories))
+		for _, repository := range info.Repositories {
+			fmt.Fprintf(w, "\t%s\n", repository.FullName)
+		}
+		cobra.CheckErr(w.Flush())
+	},
+}
@@ -0,0 +1,181 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// ErrorKind classifies GitHub API errors by what went wrong rather than by status code.
+type ErrorKind string
+
+const (
+	ErrorKindUnknown                       ErrorKind = "unknown"
+	ErrorKindBadCredentials                ErrorKind = "bad_credentials"
+	ErrorKindClockSkew                     ErrorKind = "clock_skew"
+	ErrorKindInstallationSuspended         ErrorKind = "installation_suspended"
+	ErrorKindPermissionsExceedInstallation ErrorKind = "permissions_exceed_installation"
+	ErrorKindRepositoryNotAccessible       ErrorKind = "repository_not_accessible"
+	ErrorKindNotFound                      ErrorKind = "not_found"
+	ErrorKindRateLimited                   ErrorKind = "rate_limited"
+	ErrorKindServerError                   ErrorKind = "server_error"
+)
+
+var errorHints = map[ErrorKind]string{
+	ErrorKindBadCredentials:                "check the app ID or client ID and the private key",
+	ErrorKindClockSkew:                     "local clock is out of sync with GitHub - sync it or adjust --jwt-iat-drift/--jwt-exp-drift",
+	ErrorKindInstallationSuspended:         "the installation is suspended - an owner of the account must unsuspend it in the app installation settings",
+	ErrorKindPermissionsExceedInstallation: "requested permissions are not granted to the installation - request less, use clamp_permissions, or have the owner accept updated permissions",
+	ErrorKindRepositoryNotAccessible:       "a requested repository does not exist or is not accessible to the installation - check repositories and repository_ids",
+	ErrorKindNotFound:                      "check the installation, the app and the API URL",
+	ErrorKindRateLimited:                   "the app is rate limited - retry later or raise --retry-max-wait",
+	ErrorKindServerError:                   "GitHub API is unavailable - retry later",
+}
+
+type APIError struct {
+	Operation string
+	Status    int
+	Body      string
+
+	// Message and DocumentationURL are parsed from the GitHub error response, if any.
+	Message          string
+	DocumentationURL string
+
+	Kind ErrorKind
+
+	// ClockSkew is GitHub server time (from the Date header) minus local time, zero if unknown.
+	ClockSkew time.Duration
+
+	// Header is the response header.
+	Header http.Header
+
+	ResponseInfo
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("github api %s failed: status=%d %s body=%s", e.Operation, e.Status, e.ResponseInfo, e.Body)
+	}
+	message := fmt.Sprintf("github api %s failed: status=%d kind=%s message=%q", e.Operation, e.Status, e.Kind, e.Message)
+	if hint, ok := errorHints[e.Kind]; ok {
+		message = fmt.Sprintf("%s: %s", message, hint)
+	}
+	if e.DocumentationURL != "" {
+		message = fmt.Sprintf("%s (see %s)", message, e.DocumentationURL)
+	}
+	if e.RequestID != "" {
+		message = fmt.Sprintf("%s [request_id=%s]", message, e.RequestID)
+	}
+	return message
+}
+
+// InstallationSuspendedError is returned when the installation was found, but is suspended.
+type InstallationSuspendedError struct {
+	InstallationID int
+	Account        string
+	SuspendedAt    time.Time
+}
+
+func (e *InstallationSuspendedError) Error() string {
+	return fmt.Sprintf(
+		"installation %d for %s was suspended at %s: %s",
+		e.InstallationID, e.Account, e.SuspendedAt.UTC().Format(time.RFC3339), errorHints[ErrorKindInstallationSuspended],
+	)
+}
+
+// Kind classifies err, ErrorKindUnknown if it is not a GitHub API error.
+func Kind(err error) ErrorKind {
+	var suspendedErr *InstallationSuspendedError
+	if errors.As(err, &suspendedErr) {
+		return ErrorKindInstallationSuspended
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Kind
+	}
+	return ErrorKindUnknown
+}
+
+// ClockSkewThreshold is the smallest clock skew worth correcting. The Date header has a resolution of a second
+// and the response takes time to arrive, so smaller differences are noise.
+const ClockSkewThreshold = 5 * time.Second
+
+// ClockSkew reports the server clock skew if err is a JWT rejected for its iat or exp claims,
+// and the skew is at least ClockSkewThreshold.
+func ClockSkew(err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	if apiErr.Kind != ErrorKindClockSkew || apiErr.ClockSkew.Abs() < ClockSkewThreshold {
+		return 0, false
+	}
+	return apiErr.ClockSkew, true
+}
+
+// IsNotFound reports whether err is a 404 response from GitHub API.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
+
+func newAPIError(operation string, resp *http.Response, bodyLog string, info ResponseInfo) *APIError {
+	apiErr := &APIError{
+		Operation:    operation,
+		Status:       resp.StatusCode,
+		Body:         bodyLog,
+		Header:       resp.Header,
+		ResponseInfo: info,
+	}
+
+	parsed := struct {
+		Message          string `json:"message"`
+		DocumentationURL string `json:"documentation_url"`
+	}{}
+	if err := json.Unmarshal([]byte(bodyLog), &parsed); err == nil {
+		apiErr.Message = parsed.Message
+		apiErr.DocumentationURL = parsed.DocumentationURL
+	}
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		apiErr.ClockSkew = time.Until(date).Truncate(time.Second)
+		if apiErr.ClockSkew != 0 {
+			logger.Get().Printf("Detected clock skew of %s against GitHub server time", apiErr.ClockSkew)
+		}
+	}
+
+	apiErr.Kind = classify(apiErr)
+	return apiErr
+}
+
+func classify(apiErr *APIError) ErrorKind {
+	message := strings.ToLower(apiErr.Message)
+	if message == "" {
+		message = strings.ToLower(apiErr.Body)
+	}
+
+	switch {
+	case apiErr.Status == http.StatusUnauthorized && (strings.Contains(message, "('iat')") || strings.Contains(message, "('exp')")):
+		return ErrorKindClockSkew
+	case apiErr.Status == http.StatusUnauthorized:
+		return ErrorKindBadCredentials
+	case strings.Contains(message, "suspended"):
+		return ErrorKindInstallationSuspended
+	case apiErr.Status == http.StatusTooManyRequests || (apiErr.Status == http.StatusForbidden && isRateLimited(apiErr)):
+		return ErrorKindRateLimited
+	case apiErr.Status == http.StatusUnprocessableEntity && strings.Contains(message, "permissions"):
+		return ErrorKindPermissionsExceedInstallation
+	case apiErr.Status == http.StatusUnprocessableEntity && strings.Contains(message, "repositor"):
+		return ErrorKindRepositoryNotAccessible
+	case apiErr.Status == http.StatusNotFound:
+		return ErrorKindNotFound
+	case apiErr.Status >= 500:
+		return ErrorKindServerError
+	}
+	return ErrorKindUnknown
+}
@@ -2,131 +2,561 @@ package github
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/plumber-cd/github-apps-trampoline/logger"
 )
 
+const DefaultUserAgent = "github-apps-trampoline"
+
 type AppInstallationAccount struct {
 	Login string `json:"login"`
+	ID    int    `json:"id,omitempty"`
+	Type  string `json:"type,omitempty"`
+
+	// Slug and Name are set instead of Login for enterprise accounts.
+	Slug string `json:"slug,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Handle returns the login of the account, or the slug for enterprise accounts.
+func (a AppInstallationAccount) Handle() string {
+	if a.Login != "" {
+		return a.Login
+	}
+	return a.Slug
 }
 
 type AppInstallation struct {
-	ID      int                    `json:"id"`
-	Account AppInstallationAccount `json:"account"`
+	ID                  int                    `json:"id"`
+	Account             AppInstallationAccount `json:"account"`
+	TargetType          string                 `json:"target_type,omitempty"`
+	RepositorySelection string                 `json:"repository_selection,omitempty"`
+	Permissions         map[string]string      `json:"permissions,omitempty"`
+	SuspendedAt         *time.Time             `json:"suspended_at,omitempty"`
+}
+
+type Repository struct {
+	ID       int                     `json:"id"`
+	Name     string                  `json:"name"`
+	FullName string                  `json:"full_name"`
+	Private  bool                    `json:"private"`
+	Owner    *AppInstallationAccount `json:"owner,omitempty"`
+	Topics   []string                `json:"topics,omitempty"`
 }
 
 type AppInstallationAccessToken struct {
-	Token string `json:"token"`
+	Token               string            `json:"token"`
+	ExpiresAt           time.Time         `json:"expires_at"`
+	Permissions         map[string]string `json:"permissions,omitempty"`
+	RepositorySelection string            `json:"repository_selection,omitempty"`
+	Repositories        []Repository      `json:"repositories,omitempty"`
 }
 
-type APIError struct {
-	Operation string
-	Status    int
-	Body      string
+type ClientOptions struct {
+	// Timeout limits each individual HTTP request, zero means no limit.
+	Timeout time.Duration
+
+	// UserAgent is sent with every request, DefaultUserAgent if empty.
+	UserAgent string
+
+	// Retry controls retries of transient failures.
+	Retry RetryPolicy
+
+	// Transport controls proxy and TLS settings.
+	Transport TransportOptions
+
+	// RateLimitWarnThreshold prints a warning when fewer requests remain in the rate limit, zero disables it.
+	RateLimitWarnThreshold int
+
+	// APIVersion is sent as X-GitHub-Api-Version, none if empty.
+	// APIVersionAuto must be resolved with DetectAPIVersion by the caller.
+	APIVersion string
 }
 
-func (e *APIError) Error() string {
-	return fmt.Sprintf("github api %s failed: status=%d body=%s", e.Operation, e.Status, e.Body)
+// Client is a GitHub REST API client for a single API base URL.
+type Client struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	UserAgent  string
+	Retry      RetryPolicy
+	APIVersion string
+
+	RateLimitWarnThreshold int
+
+	rateLimitWarned sync.Once
 }
 
-func GetInstallations(api string, jwt string) ([]AppInstallation, error) {
-	logger.Get().Printf("Getting known installations for jwt from %s", api)
+func NewClient(baseURL string, opts ClientOptions) (*Client, error) {
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	transport, err := newTransport(opts.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		HTTPClient: &http.Client{Timeout: opts.Timeout, Transport: transport},
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		UserAgent:  userAgent,
+		Retry:      opts.Retry,
+		APIVersion: opts.APIVersion,
 
-	client := http.Client{}
-	installations := []AppInstallation{}
-	page := 1
-	for {
-		req, err := http.NewRequest("GET", fmt.Sprintf("%s/app/installations?per_page=100&page=%d", api, page), nil)
+		RateLimitWarnThreshold: opts.RateLimitWarnThreshold,
+	}, nil
+}
+
+// InstallationsPage is a single page of the app installations list, kept with its ETag for conditional requests.
+type InstallationsPage struct {
+	URL           string            `json:"url,omitempty"`
+	ETag          string            `json:"etag,omitempty"`
+	Next          string            `json:"next,omitempty"`
+	Last          string            `json:"last,omitempty"`
+	Installations []AppInstallation `json:"installations"`
+}
+
+func (c *Client) GetInstallations(ctx context.Context, jwt string) ([]AppInstallation, error) {
+	pages, err := c.GetInstallationPages(ctx, jwt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return FlattenInstallationPages(pages), nil
+}
+
+// GetInstallationPages lists installations page by page, following URLs from the Link header.
+// When the last page is known, the remaining pages are fetched concurrently.
+// Pages with a known ETag in previous are requested with If-None-Match, and reused as is if GitHub responds with 304.
+func (c *Client) GetInstallationPages(ctx context.Context, jwt string, previous []InstallationsPage) ([]InstallationsPage, error) {
+	logger.Get().Printf("Getting known installations for jwt from %s", c.BaseURL)
+
+	known := map[string]InstallationsPage{}
+	for _, page := range previous {
+		if page.URL != "" {
+			known[page.URL] = page
+		}
+	}
+
+	first, err := c.getInstallationsPage(ctx, jwt, "/app/installations?per_page=100", known)
+	if err != nil {
+		return nil, err
+	}
+	pages := []InstallationsPage{*first}
+	if len(first.Installations) == 0 {
+		return pages, nil
+	}
+
+	if urls := pageURLs(first.Next, first.Last); urls != nil {
+		rest, err := c.getInstallationPagesConcurrently(ctx, jwt, urls, known)
 		if err != nil {
 			return nil, err
 		}
+		return append(pages, rest...), nil
+	}
 
-		req.Header = http.Header{
-			"Accept":        []string{"application/vnd.github.v3+json"},
-			"Authorization": []string{"Bearer " + jwt},
+	for next := first.Next; next != ""; {
+		page, err := c.getInstallationsPage(ctx, jwt, next, known)
+		if err != nil {
+			return nil, err
 		}
+		pages = append(pages, *page)
+		if len(page.Installations) == 0 {
+			break
+		}
+		next = page.Next
+	}
+	return pages, nil
+}
+
+func (c *Client) getInstallationPagesConcurrently(ctx context.Context, jwt string, urls []string, known map[string]InstallationsPage) ([]InstallationsPage, error) {
+	logger.Get().Printf("Fetching %d more pages of installations with up to %d workers", len(urls), paginationWorkers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		resp, err := client.Do(req)
+	pages := make([]InstallationsPage, len(urls))
+	workers := make(chan struct{}, paginationWorkers)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	var firstErr error
+	for i, pageURL := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			page, err := c.getInstallationsPage(ctx, jwt, pageURL, known)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			pages[i] = *page
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return pages, nil
+}
+
+func (c *Client) getInstallationsPage(ctx context.Context, jwt, pageURL string, known map[string]InstallationsPage) (*InstallationsPage, error) {
+	header := http.Header{}
+	previous, isKnown := known[pageURL]
+	if isKnown && previous.ETag != "" {
+		header.Set("If-None-Match", previous.ETag)
+	}
+	resp, body, err := c.doWithHeader(ctx, "list_installations", "GET", pageURL, "Bearer "+jwt, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		logger.Get().Printf("Page %s was not modified", pageURL)
+		return &previous, nil
+	}
+
+	links := parseLinks(resp.Header.Get("Link"))
+	page := InstallationsPage{URL: pageURL, ETag: resp.Header.Get("ETag"), Next: links["next"], Last: links["last"]}
+	if err := json.Unmarshal(body, &page.Installations); err != nil {
+		return nil, err
+	}
+	logger.Get().Printf("Found page %s: %d installations", pageURL, len(page.Installations))
+	return &page, nil
+}
+
+// FlattenInstallationPages joins installations from all pages.
+func FlattenInstallationPages(pages []InstallationsPage) []AppInstallation {
+	installations := []AppInstallation{}
+	for _, page := range pages {
+		installations = append(installations, page.Installations...)
+	}
+	return installations
+}
+
+type installationRepositories struct {
+	TotalCount   int          `json:"total_count"`
+	Repositories []Repository `json:"repositories"`
+}
+
+// GetInstallationRepositories lists repositories accessible to an installation token.
+func (c *Client) GetInstallationRepositories(ctx context.Context, token string) ([]Repository, error) {
+	logger.Get().Printf("Getting repositories accessible to the installation from %s", c.BaseURL)
+
+	repositories := []Repository{}
+	for next := "/installation/repositories?per_page=100"; next != ""; {
+		resp, body, err := c.do(ctx, "list_installation_repositories", "GET", next, "token "+token, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		body, bodyLog, err := readBody(resp)
-		if err != nil {
+		pageRepositories := installationRepositories{}
+		if err := json.Unmarshal(body, &pageRepositories); err != nil {
 			return nil, err
 		}
 
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			return nil, &APIError{
-				Operation: "list_installations",
-				Status:    resp.StatusCode,
-				Body:      bodyLog,
+		logger.Get().Printf("Found page %s: %d repositories", next, len(pageRepositories.Repositories))
+		repositories = append(repositories, pageRepositories.Repositories...)
+
+		if len(pageRepositories.Repositories) == 0 {
+			break
+		}
+		next = parseLinks(resp.Header.Get("Link"))["next"]
+	}
+
+	return repositories, nil
+}
+
+// RepositoryPropertyValue is a custom property value, a string or a list of strings for multi select properties.
+type RepositoryPropertyValue struct {
+	PropertyName string          `json:"property_name"`
+	Value        json.RawMessage `json:"value"`
+}
+
+// Matches reports whether the value is, or for multi select properties contains, value.
+func (v RepositoryPropertyValue) Matches(value string) bool {
+	var single string
+	if err := json.Unmarshal(v.Value, &single); err == nil {
+		return single == value
+	}
+	var multiple []string
+	if err := json.Unmarshal(v.Value, &multiple); err == nil {
+		for _, item := range multiple {
+			if item == value {
+				return true
 			}
 		}
+	}
+	return false
+}
+
+type RepositoryProperties struct {
+	RepositoryID   int                       `json:"repository_id"`
+	RepositoryName string                    `json:"repository_name"`
+	Properties     []RepositoryPropertyValue `json:"properties"`
+}
+
+// GetRepositoryPropertyValues lists custom property values of repositories in the organization.
+// The token needs organization_custom_properties read permission.
+func (c *Client) GetRepositoryPropertyValues(ctx context.Context, token, org string) ([]RepositoryProperties, error) {
+	logger.Get().Printf("Getting custom property values for organization %s from %s", org, c.BaseURL)
+
+	values := []RepositoryProperties{}
+	for next := fmt.Sprintf("/orgs/%s/properties/values?per_page=100", url.PathEscape(org)); next != ""; {
+		resp, body, err := c.do(ctx, "list_repository_property_values", "GET", next, "token "+token, nil)
+		if err != nil {
+			return nil, err
+		}
 
-		pageInstallations := []AppInstallation{}
-		if err := json.Unmarshal(body, &pageInstallations); err != nil {
+		pageValues := []RepositoryProperties{}
+		if err := json.Unmarshal(body, &pageValues); err != nil {
 			return nil, err
 		}
 
-		logger.Get().Printf("Found page %d: %d installations", page, len(pageInstallations))
-		installations = append(installations, pageInstallations...)
+		logger.Get().Printf("Found page %s: %d repositories", next, len(pageValues))
+		values = append(values, pageValues...)
 
-		if !hasNextPage(resp.Header.Get("Link")) || len(pageInstallations) == 0 {
+		if len(pageValues) == 0 {
 			break
 		}
-		page += 1
+		next = parseLinks(resp.Header.Get("Link"))["next"]
 	}
 
-	return installations, nil
+	return values, nil
 }
 
-func GetToken(api string, jwt string, appID int, body []byte) (*AppInstallationAccessToken, error) {
-	logger.Get().Printf("Getting token for appID=%d with current jwt from %s: %s", appID, api, string(body))
+type RateLimit struct {
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	Reset     int64 `json:"reset"`
+	Used      int   `json:"used"`
+}
+
+type RateLimits struct {
+	Resources map[string]RateLimit `json:"resources"`
+
+	// TokenExpiresAt is read from the GitHub-Authentication-Token-Expiration header, nil if GitHub did not send it.
+	TokenExpiresAt *time.Time `json:"-"`
+}
+
+// GetRateLimit reports rate limit status for a token, it does not count against the rate limit itself.
+func (c *Client) GetRateLimit(ctx context.Context, token string) (*RateLimits, error) {
+	logger.Get().Printf("Getting rate limit status from %s", c.BaseURL)
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/app/installations/%d/access_tokens", api, appID), bytes.NewBuffer(body))
+	resp, body, err := c.do(ctx, "get_rate_limit", "GET", "/rate_limit", "token "+token, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header = http.Header{
-		"Accept":        []string{"application/vnd.github.v3+json"},
-		"Authorization": []string{"Bearer " + jwt},
+	rateLimits := RateLimits{}
+	if err := json.Unmarshal(body, &rateLimits); err != nil {
+		return nil, err
+	}
+
+	if expiration := resp.Header.Get("GitHub-Authentication-Token-Expiration"); expiration != "" {
+		for _, layout := range []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700", time.RFC3339} {
+			if expiresAt, err := time.Parse(layout, expiration); err == nil {
+				rateLimits.TokenExpiresAt = &expiresAt
+				break
+			}
+		}
 	}
 
-	client := http.Client{}
-	resp, err := client.Do(req)
+	return &rateLimits, nil
+}
+
+func (c *Client) GetToken(ctx context.Context, jwt string, installationID int, body []byte) (*AppInstallationAccessToken, error) {
+	logger.Get().Printf("Getting token for installationID=%d with current jwt from %s: %s", installationID, c.BaseURL, string(body))
+
+	_, tokenBody, err := c.do(ctx, "get_token", "POST", fmt.Sprintf("/app/installations/%d/access_tokens", installationID), "Bearer "+jwt, body)
 	if err != nil {
 		return nil, err
 	}
 
-	tokenBody, tokenBodyLog, err := readBody(resp)
+	logger.Filef("Token response: %s", string(tokenBody))
+	logger.Stderrf("Token response: %s", redactToken(string(tokenBody)))
+
+	token := AppInstallationAccessToken{}
+	if err := json.Unmarshal(tokenBody, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (c *Client) GetInstallation(ctx context.Context, jwt string, installationID int) (*AppInstallation, error) {
+	logger.Get().Printf("Getting installation %d from %s", installationID, c.BaseURL)
+	return c.getInstallation(ctx, "get_installation", jwt, fmt.Sprintf("/app/installations/%d", installationID))
+}
+
+func (c *Client) GetRepositoryInstallation(ctx context.Context, jwt, owner, repo string) (*AppInstallation, error) {
+	logger.Get().Printf("Getting installation for repository %s/%s from %s", owner, repo, c.BaseURL)
+	return c.getInstallation(ctx, "get_repository_installation", jwt, fmt.Sprintf("/repos/%s/%s/installation", url.PathEscape(owner), url.PathEscape(repo)))
+}
+
+func (c *Client) GetOrganizationInstallation(ctx context.Context, jwt, org string) (*AppInstallation, error) {
+	logger.Get().Printf("Getting installation for organization %s from %s", org, c.BaseURL)
+	return c.getInstallation(ctx, "get_organization_installation", jwt, fmt.Sprintf("/orgs/%s/installation", url.PathEscape(org)))
+}
+
+func (c *Client) GetUserInstallation(ctx context.Context, jwt, user string) (*AppInstallation, error) {
+	logger.Get().Printf("Getting installation for user %s from %s", user, c.BaseURL)
+	return c.getInstallation(ctx, "get_user_installation", jwt, fmt.Sprintf("/users/%s/installation", url.PathEscape(user)))
+}
+
+// GetAccount gets a user or an organization by login. The request is not authenticated.
+func (c *Client) GetAccount(ctx context.Context, login string) (*AppInstallationAccount, error) {
+	logger.Get().Printf("Getting account %s from %s", login, c.BaseURL)
+	_, body, err := c.do(ctx, "get_account", "GET", fmt.Sprintf("/users/%s", url.PathEscape(login)), "", nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, &APIError{
-			Operation: "get_token",
-			Status:    resp.StatusCode,
-			Body:      tokenBodyLog,
-		}
+	account := AppInstallationAccount{}
+	if err := json.Unmarshal(body, &account); err != nil {
+		return nil, err
 	}
+	return &account, nil
+}
 
-	logger.Filef("Token response: %s", tokenBodyLog)
-	logger.Stderrf("Token response: %s", redactToken(tokenBodyLog))
+// GetRepository gets a public repository, following redirects of renamed repositories and owners.
+// The request is not authenticated.
+func (c *Client) GetRepository(ctx context.Context, owner, repo string) (*Repository, error) {
+	logger.Get().Printf("Getting repository %s/%s from %s", owner, repo, c.BaseURL)
+	_, body, err := c.do(ctx, "get_repository", "GET", fmt.Sprintf("/repos/%s/%s", url.PathEscape(owner), url.PathEscape(repo)), "", nil)
+	if err != nil {
+		return nil, err
+	}
 
-	token := AppInstallationAccessToken{}
-	if err := json.Unmarshal(tokenBody, &token); err != nil {
+	repository := Repository{}
+	if err := json.Unmarshal(body, &repository); err != nil {
 		return nil, err
 	}
+	return &repository, nil
+}
 
-	return &token, nil
+func (c *Client) getInstallation(ctx context.Context, operation, jwt, path string) (*AppInstallation, error) {
+	_, body, err := c.do(ctx, operation, "GET", path, "Bearer "+jwt, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	installation := AppInstallation{}
+	if err := json.Unmarshal(body, &installation); err != nil {
+		return nil, err
+	}
+
+	logger.Get().Printf("Found installation %d for %s", installation.ID, installation.Account.Handle())
+	return &installation, nil
+}
+
+func (c *Client) RevokeToken(ctx context.Context, token string) error {
+	logger.Get().Printf("Revoking installation token at %s", c.BaseURL)
+	_, _, err := c.do(ctx, "revoke_token", "DELETE", "/installation/token", "token "+token, nil)
+	return err
+}
+
+// do sends a request relative to BaseURL and returns the response with its body already read.
+// Non-2xx responses are returned as *APIError. Transient failures are retried according to c.Retry.
+func (c *Client) do(ctx context.Context, operation, method, path, authorization string, body []byte) (*http.Response, []byte, error) {
+	return c.doWithHeader(ctx, operation, method, path, authorization, body, nil)
+}
+
+// doWithHeader is like do, but sends additional headers.
+// If the request is conditional (has If-None-Match), a 304 response is returned as is instead of an error.
+func (c *Client) doWithHeader(ctx context.Context, operation, method, path, authorization string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	attempts := c.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		resp, raw, err := c.doOnce(ctx, operation, method, path, authorization, body, header)
+		if err == nil {
+			return resp, raw, nil
+		}
+		if attempt >= attempts {
+			return nil, nil, err
+		}
+		wait, retryable := c.Retry.backoff(ctx, attempt, err)
+		if !retryable {
+			return nil, nil, err
+		}
+		logger.Get().Printf("github api %s attempt %d/%d failed, retrying in %s: %v", operation, attempt, attempts, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, operation, method, path, authorization string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	requestURL, err := c.resolveURL(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reqBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header = http.Header{
+		"Accept":     []string{"application/vnd.github.v3+json"},
+		"User-Agent": []string{c.UserAgent},
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if c.APIVersion != "" && c.APIVersion != APIVersionAuto {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("X-GitHub-Api-Version", c.APIVersion)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, bodyLog, err := readBody(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := newResponseInfo(resp.Header)
+	c.logResponse(operation, resp.StatusCode, info)
+
+	if resp.StatusCode == http.StatusNotModified && header.Get("If-None-Match") != "" {
+		return resp, nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, newAPIError(operation, resp, bodyLog, info)
+	}
+
+	return resp, raw, nil
 }
 
 func readBody(resp *http.Response) ([]byte, string, error) {
@@ -142,19 +572,6 @@ func readBody(resp *http.Response) ([]byte, string, error) {
 	return raw, bodyLog, nil
 }
 
-func hasNextPage(linkHeader string) bool {
-	if linkHeader == "" {
-		return false
-	}
-	parts := strings.Split(linkHeader, ",")
-	for _, part := range parts {
-		if strings.Contains(part, `rel="next"`) {
-			return true
-		}
-	}
-	return false
-}
-
 func redactToken(body string) string {
 	needle := `"token":"`
 	start := strings.Index(body, needle)
@@ -2,7 +2,6 @@ package github
 
 import (
 	"os"
-	"strconv"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v4"
@@ -10,8 +9,22 @@ import (
 	"github.com/plumber-cd/github-apps-trampoline/logger"
 )
 
-func CreateJWT(privateKeyPath string, appID int) (string, error) {
-	logger.Get().Printf("Creating JWT using privateKeyPath=%s appID=%d", privateKeyPath, appID)
+// MaxJWTLifetime is the maximum lifetime GitHub accepts for an app JWT.
+const MaxJWTLifetime = 10 * time.Minute
+
+type JWTOptions struct {
+	// IssuedAtDrift is how far back iat is dated to tolerate clock drift.
+	IssuedAtDrift time.Duration
+
+	// ExpirationDrift is subtracted from MaxJWTLifetime to tolerate clock drift.
+	ExpirationDrift time.Duration
+
+	// ClockSkew is the difference between GitHub server time and local time, added to local time.
+	ClockSkew time.Duration
+}
+
+func CreateJWT(privateKeyPath string, issuer string, opts JWTOptions) (string, error) {
+	logger.Get().Printf("Creating JWT using privateKeyPath=%s issuer=%s clockSkew=%s", privateKeyPath, issuer, opts.ClockSkew)
 
 	signBytes, err := os.ReadFile(privateKeyPath)
 	if err != nil {
@@ -23,11 +36,12 @@ func CreateJWT(privateKeyPath string, appID int) (string, error) {
 		return "", err
 	}
 
+	now := time.Now().Add(opts.ClockSkew)
 	t := jwt.New(jwt.GetSigningMethod("RS256"))
 	t.Claims = jwt.RegisteredClaims{
-		IssuedAt:  jwt.NewNumericDate(time.Now().Add(-time.Second * 60)), // Allow 1 minute drift
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 9)),   // Max is 10 mins, allow 1 minute drift
-		Issuer:    strconv.Itoa(appID),
+		IssuedAt:  jwt.NewNumericDate(now.Add(-opts.IssuedAtDrift)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(MaxJWTLifetime - opts.ExpirationDrift)),
+		Issuer:    issuer,
 	}
 
 	token, err := t.SignedString(signKey)
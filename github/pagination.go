@@ -0,0 +1,80 @@
+package github
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// paginationWorkers bounds how many pages are fetched at once when the number of pages is known upfront.
+const paginationWorkers = 4
+
+// parseLinks parses a Link header into a map of rel to URL.
+func parseLinks(linkHeader string) map[string]string {
+	links := map[string]string{}
+	for _, part := range strings.Split(linkHeader, ",") {
+		segments := strings.Split(part, ";")
+		target := strings.TrimSpace(segments[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+		for _, param := range segments[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && name == "rel" {
+				for _, rel := range strings.Fields(strings.Trim(value, `"`)) {
+					links[rel] = target
+				}
+			}
+		}
+	}
+	return links
+}
+
+// pageURLs expands next and last links into URLs of all remaining pages.
+// Returns nil if the links are not numbered pages, e.g. with cursor based pagination.
+func pageURLs(next, last string) []string {
+	if next == "" || last == "" {
+		return nil
+	}
+	nextURL, err := url.Parse(next)
+	if err != nil {
+		return nil
+	}
+	lastURL, err := url.Parse(last)
+	if err != nil {
+		return nil
+	}
+	nextPage, err := strconv.Atoi(nextURL.Query().Get("page"))
+	if err != nil {
+		return nil
+	}
+	lastPage, err := strconv.Atoi(lastURL.Query().Get("page"))
+	if err != nil || lastPage < nextPage {
+		return nil
+	}
+
+	urls := []string{}
+	for page := nextPage; page <= lastPage; page++ {
+		query := nextURL.Query()
+		query.Set("page", strconv.Itoa(page))
+		pageURL := *nextURL
+		pageURL.RawQuery = query.Encode()
+		urls = append(urls, pageURL.String())
+	}
+	return urls
+}
+
+// resolveURL turns a path relative to BaseURL into a full URL.
+// Absolute URLs (e.g. from Link headers) are used as is, but only if they point to the same API,
+// so that credentials are never sent elsewhere.
+func (c *Client) resolveURL(path string) (string, error) {
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return c.BaseURL + path, nil
+	}
+	if !strings.HasPrefix(path, c.BaseURL+"/") {
+		return "", fmt.Errorf("refusing to follow %s outside of %s", path, c.BaseURL)
+	}
+	return path, nil
+}
@@ -0,0 +1,64 @@
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// ResponseInfo is diagnostic information GitHub sends with every response.
+// GitHub support asks for the RequestID when investigating a failure.
+type ResponseInfo struct {
+	RequestID string
+
+	// RateLimitRemaining is -1 if the response had no rate limit headers.
+	RateLimitLimit     int
+	RateLimitRemaining int
+	RateLimitReset     time.Time
+	RateLimitResource  string
+}
+
+func newResponseInfo(header http.Header) ResponseInfo {
+	info := ResponseInfo{
+		RequestID:          header.Get("X-GitHub-Request-Id"),
+		RateLimitResource:  header.Get("X-RateLimit-Resource"),
+		RateLimitRemaining: -1,
+	}
+	if limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit")); err == nil {
+		info.RateLimitLimit = limit
+	}
+	if remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining")); err == nil {
+		info.RateLimitRemaining = remaining
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		info.RateLimitReset = time.Unix(reset, 0)
+	}
+	return info
+}
+
+func (i ResponseInfo) String() string {
+	s := fmt.Sprintf("request_id=%s", i.RequestID)
+	if i.RateLimitRemaining >= 0 {
+		s = fmt.Sprintf(
+			"%s rate_limit_remaining=%d rate_limit_reset=%s rate_limit_resource=%s",
+			s, i.RateLimitRemaining, i.RateLimitReset.UTC().Format(time.RFC3339), i.RateLimitResource,
+		)
+	}
+	return s
+}
+
+// logResponse records the response in the file log and warns if the remaining rate limit is below the threshold.
+func (c *Client) logResponse(operation string, status int, info ResponseInfo) {
+	logger.Filef("github api %s: status=%d %s", operation, status, info)
+	if c.RateLimitWarnThreshold > 0 && info.RateLimitRemaining >= 0 && info.RateLimitRemaining < c.RateLimitWarnThreshold {
+		c.rateLimitWarned.Do(func() {
+			logger.Warnf(
+				"GitHub API rate limit is running low: %d requests left for resource %q until %s",
+				info.RateLimitRemaining, info.RateLimitResource, info.RateLimitReset.Local().Format(time.RFC3339),
+			)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SecondaryRateLimitWait is the minimum wait after a secondary rate limit that doesn't say how long to wait,
+// as GitHub asks to wait at least a minute before retrying.
+const SecondaryRateLimitWait = time.Minute
+
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one, values below 1 mean no retries.
+	MaxAttempts int
+
+	// MaxWait caps the wait before a single retry.
+	// If GitHub asks to wait longer via Retry-After or X-RateLimit-Reset - the error is returned instead.
+	MaxWait time.Duration
+}
+
+// backoff returns how long to wait before the next attempt and whether err is worth retrying at all.
+func (p RetryPolicy) backoff(ctx context.Context, attempt int, err error) (time.Duration, bool) {
+	if ctx.Err() != nil {
+		return 0, false
+	}
+
+	// Up to half of the wait is random, so concurrent helpers don't retry in lockstep.
+	exponential := time.Second << (attempt - 1)
+	exponential = exponential/2 + rand.N(exponential/2+1)
+	if p.MaxWait > 0 && exponential > p.MaxWait {
+		exponential = p.MaxWait
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return exponential, isTransient(err)
+	}
+
+	if apiErr.Kind != ErrorKindServerError && apiErr.Kind != ErrorKindRateLimited {
+		return 0, false
+	}
+
+	wait, ok := rateLimitWait(apiErr.Header)
+	if !ok && apiErr.Kind == ErrorKindServerError {
+		return exponential, true
+	}
+	if !ok {
+		wait = max(exponential, SecondaryRateLimitWait)
+	}
+	if p.MaxWait > 0 && wait > p.MaxWait {
+		return 0, false
+	}
+	return wait, true
+}
+
+// isTransient reports whether a network error may go away on its own: timeouts, including per-request ones,
+// connections reset or refused, and responses cut short. Certificate, DNS, proxy and URL errors will not.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isRateLimited(apiErr *APIError) bool {
+	if apiErr.Header.Get("Retry-After") != "" || apiErr.Header.Get("X-RateLimit-Remaining") == "0" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(apiErr.Body), "rate limit")
+}
+
+// rateLimitWait reads the wait requested by GitHub from Retry-After or, once the budget is exhausted, X-RateLimit-Reset.
+func rateLimitWait(header http.Header) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(date), 0), true
+		}
+	}
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(time.Until(time.Unix(reset, 0)), 0) + time.Second, true
+		}
+	}
+	return 0, false
+}
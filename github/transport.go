@@ -0,0 +1,79 @@
+package github
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+type TransportOptions struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string
+
+	// ClientCert and ClientKey are PEM files with the client certificate presented for mTLS.
+	ClientCert string
+	ClientKey  string
+
+	// Proxy is an HTTP(S) proxy URL, by default HTTPS_PROXY/HTTP_PROXY/NO_PROXY are used.
+	Proxy string
+
+	// InsecureSkipVerify disables TLS certificate verification.
+	InsecureSkipVerify bool
+}
+
+func newTransport(opts TransportOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", opts.Proxy, err)
+		}
+		logger.Get().Printf("Using proxy %s", proxyURL.Redacted())
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if opts.CAFile != "" {
+		logger.Get().Printf("Trusting CA bundle %s", opts.CAFile)
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			logger.Get().Printf("Failed to load system cert pool, using CA bundle only: %v", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		if opts.ClientCert == "" || opts.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and client key must be set together")
+		}
+		logger.Get().Printf("Using client certificate %s", opts.ClientCert)
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.InsecureSkipVerify {
+		logger.Warnf("TLS certificate verification is disabled - connections to GitHub API are not secure")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,77 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+const (
+	// DefaultAPIVersion is the REST API version used in auto mode against github.com and recent GHES.
+	DefaultAPIVersion = "2022-11-28"
+
+	// APIVersionAuto detects the API version to use from the server's /meta.
+	APIVersionAuto = "auto"
+)
+
+// minGHESVersionHeader is the first GHES release that understands the X-GitHub-Api-Version header.
+var minGHESVersionHeader = [2]int{3, 9}
+
+type Meta struct {
+	// InstalledVersion is only reported by GitHub Enterprise Server.
+	InstalledVersion string `json:"installed_version,omitempty"`
+}
+
+func (c *Client) GetMeta(ctx context.Context) (*Meta, error) {
+	logger.Get().Printf("Getting meta from %s", c.BaseURL)
+	_, body, err := c.do(ctx, "get_meta", "GET", "/meta", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := Meta{}
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// DetectAPIVersion picks the REST API version supported by the server.
+// GHES releases that predate API versioning get an empty version, so that no version header is sent at all.
+func (c *Client) DetectAPIVersion(ctx context.Context) (string, error) {
+	meta, err := c.GetMeta(ctx)
+	if err != nil {
+		return "", err
+	}
+	if meta.InstalledVersion == "" {
+		logger.Get().Printf("%s is not GitHub Enterprise Server, using API version %s", c.BaseURL, DefaultAPIVersion)
+		return DefaultAPIVersion, nil
+	}
+	if !supportsVersionHeader(meta.InstalledVersion) {
+		logger.Get().Printf("GitHub Enterprise Server %s predates API versioning, not sending an API version", meta.InstalledVersion)
+		return "", nil
+	}
+	logger.Get().Printf("GitHub Enterprise Server %s, using API version %s", meta.InstalledVersion, DefaultAPIVersion)
+	return DefaultAPIVersion, nil
+}
+
+func supportsVersionHeader(installedVersion string) bool {
+	parts := strings.SplitN(installedVersion, ".", 3)
+	if len(parts) < 2 {
+		return true
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return true
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return true
+	}
+	if major != minGHESVersionHeader[0] {
+		return major > minGHESVersionHeader[0]
+	}
+	return minor >= minGHESVersionHeader[1]
+}
@@ -0,0 +1,182 @@
+package helper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// What to do when no rule matched the request.
+const (
+	// OnNoMatchSilent exits without output, so git moves on to the next helper in its chain.
+	OnNoMatchSilent = "silent"
+
+	// OnNoMatchFail reports an error.
+	OnNoMatchFail = "fail"
+
+	// OnNoMatchDelegate passes the request to another credential helper and relays its output.
+	OnNoMatchDelegate = "delegate"
+)
+
+// DelegatedError is returned by GetToken when the rule passed the request to its delegate credential helper.
+// Output is what the delegate wrote, to be relayed to git as is.
+type DelegatedError struct {
+	Err    error
+	Output []byte
+}
+
+func (e *DelegatedError) Error() string {
+	return fmt.Sprintf("Delegated to credential helper: %s", e.Err)
+}
+
+func (e *DelegatedError) Unwrap() error { return e.Err }
+
+// Delegate runs another git credential helper with the action (get, store or erase) and the original input.
+// The helper is specified as in git's credential.helper: a name like "cache --timeout=300" runs
+// "git credential-cache --timeout=300", an absolute path is run as is, and a value starting with "!" is a shell command.
+// Only shell commands are run via a shell.
+func Delegate(ctx context.Context, helper, action string, input []byte, stdout, stderr io.Writer) error {
+	command := strings.TrimSpace(helper)
+	if command == "" {
+		return fmt.Errorf("no credential helper configured to delegate to")
+	}
+	var cmd *exec.Cmd
+	if shell, ok := strings.CutPrefix(command, "!"); ok {
+		command = fmt.Sprintf("%s %s", shell, action)
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	} else {
+		args := strings.Fields(command)
+		if !filepath.IsAbs(args[0]) {
+			args = append([]string{"git", "credential-" + args[0]}, args[1:]...)
+		}
+		args = append(args, action)
+		command = strings.Join(args, " ")
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+
+	logger.Get().Printf("Delegating %s to credential helper: %s", action, command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("delegated credential helper %q failed: %w", command, err)
+	}
+	return nil
+}
+
+// ParseCredential parses key=value lines as read from and written by git credential helpers.
+func ParseCredential(data []byte) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSuffix(line, "\r"), "=")
+		if ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// onNoMatch applies on_no_match of the rule to an error that means no installation could serve the request.
+// Without on_no_match the error is returned as is, for the caller to decide.
+func onNoMatch(ctx context.Context, config Config, input []byte, token *github.AppInstallationAccessToken, err error) (*github.AppInstallationAccessToken, error) {
+	var s *SilentExitError
+	if err == nil || config.OnNoMatch == nil || !errors.As(err, &s) {
+		return token, err
+	}
+
+	switch *config.OnNoMatch {
+	case OnNoMatchFail:
+		return nil, s.Err
+	case OnNoMatchDelegate:
+		logger.Get().Printf("No match: %s", err)
+		out := bytes.Buffer{}
+		if err := Delegate(ctx, *config.DelegateHelper, "get", input, &out, logger.Get().Writer()); err != nil {
+			return nil, err
+		}
+		if ParseCredential(out.Bytes())["password"] == "" {
+			return nil, fmt.Errorf("delegated credential helper returned no password: %w", s.Err)
+		}
+		return nil, &DelegatedError{Err: s.Err, Output: out.Bytes()}
+	default:
+		return nil, &SilentExitError{Err: s.Err, OnNoMatch: OnNoMatchSilent}
+	}
+}
+
+// relay passes a store or erase action to the delegate of the rule, if the rule delegates
+// and no installation serves the request - that is, if the credential git has came from the delegate.
+// Returns false if the request is served by the trampoline.
+func relay(ctx context.Context, config Config, jwts *jwtSources, currentRepo, action string, input []byte, stdout, stderr io.Writer) (bool, error) {
+	if config.OnNoMatch == nil || *config.OnNoMatch != OnNoMatchDelegate {
+		return false, nil
+	}
+	if err := validateConfig(&config); err != nil {
+		return false, err
+	}
+	client, err := newClient(ctx, config)
+	if err != nil {
+		return false, err
+	}
+	_, err = withClockSkewRetry(jwts.get(config), func(jwt *jwtSource) (bool, error) {
+		return true, validateInstallationID(ctx, client, &config, jwt, currentRepo)
+	})
+	var s *SilentExitError
+	if err == nil {
+		return false, nil
+	} else if !errors.As(err, &s) {
+		return false, err
+	}
+
+	logger.Get().Printf("No match: %s", err)
+	return true, Delegate(ctx, *config.DelegateHelper, action, input, stdout, stderr)
+}
+
+// CredentialInput returns what git sent, or credential helper input for the repo path if that is not known.
+func (h GitHelper) CredentialInput() []byte {
+	if h.input != nil {
+		return h.input
+	}
+	host, path, _ := strings.Cut(h.currentRepo, "/")
+	return credentialInput(host, path)
+}
+
+// CredentialInput returns credential helper input for the installation of the config.
+func (h CLIHelper) CredentialInput() []byte {
+	return cliCredentialInput(h.config)
+}
+
+func (h GitHelper) Relay(ctx context.Context, action string, stdout, stderr io.Writer) (bool, error) {
+	return relay(ctx, h.config, h.jwts, h.currentRepo, action, h.CredentialInput(), stdout, stderr)
+}
+
+func (h CLIHelper) Relay(ctx context.Context, action string, stdout, stderr io.Writer) (bool, error) {
+	return relay(ctx, h.config, h.jwts, "", action, h.CredentialInput(), stdout, stderr)
+}
+
+// cliCredentialInput builds credential helper input for the installation of the config.
+func cliCredentialInput(config Config) []byte {
+	host := "github.com"
+	if config.GitHubServer != nil {
+		host = *config.GitHubServer
+	}
+	path := ""
+	if config.Installation != nil {
+		host, path, _ = strings.Cut(*config.Installation, "/")
+	}
+	return credentialInput(host, path)
+}
+
+func credentialInput(host, path string) []byte {
+	input := fmt.Sprintf("protocol=https\nhost=%s\n", host)
+	if path != "" {
+		input += fmt.Sprintf("path=%s\n", path)
+	}
+	return []byte(input + "\n")
+}
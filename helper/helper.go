@@ -1,12 +1,15 @@
 package helper
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/plumber-cd/github-apps-trampoline/cache"
 	"github.com/plumber-cd/github-apps-trampoline/github"
@@ -15,6 +18,9 @@ import (
 
 type SilentExitError struct {
 	Err error
+
+	// OnNoMatch is set when the rule chose silent on_no_match, so it is not overridden by the caller's default.
+	OnNoMatch string
 }
 
 func (m *SilentExitError) Error() string {
@@ -30,12 +36,21 @@ type Config struct {
 	// GitHubAPI is address for GitHub API - by default it's automatically inferred from GitHubServer.
 	GitHubAPI *string `json:"api,omitempty"`
 
+	// APIVersion is a REST API version to send with every request, or "auto" to detect it from the server.
+	// Overrides the global setting.
+	APIVersion *string `json:"api_version,omitempty"`
+
 	// PrivateKey is a path to the key file.
 	PrivateKey string `json:"key"`
 
 	// AppID is a GitHub App ID.
+	// Either AppID or ClientID must be set.
 	AppID int `json:"app"`
 
+	// ClientID is a GitHub App Client ID.
+	// If set - it is used as the JWT issuer instead of AppID.
+	ClientID string `json:"client_id,omitempty"`
+
 	// CurrentRepositoryOnly if set to true - will request access for the current repository.
 	// Ignores Repositories and RepositoryIDs.
 	CurrentRepositoryOnly *bool `json:"current_repo,omitempty"`
@@ -52,6 +67,17 @@ type Config struct {
 	// If neither Repositories nor RepositoryIDs is provided - will default to all repositories in this installation.
 	RepositoryIDs *[]int `json:"repository_ids,omitempty"`
 
+	// RepositorySelector adds repositories of the installation matched by name, topics or a custom property to Repositories.
+	RepositorySelector *RepositorySelector `json:"repository_selector,omitempty"`
+
+	// IncludeSubmodules if set to true - adds repositories of submodules from .gitmodules in the current working tree
+	// to Repositories, if they belong to the installation owner.
+	IncludeSubmodules *bool `json:"include_submodules,omitempty"`
+
+	// ResolveRepositories if set to true - resolves Repositories to IDs and checks that the installation
+	// has access to every requested repository before requesting a token.
+	ResolveRepositories *bool `json:"resolve_repositories,omitempty"`
+
 	// Permissions is a JSON object representing what access the token must have.
 	Permissions *json.RawMessage `json:"permissions,omitempty"`
 
@@ -61,25 +87,165 @@ type Config struct {
 	// InstallationID is ID of the installation that should be used to request token.
 	InstallationID *int `json:"installation_id,omitempty"`
 
+	// InstallationType restricts the installation lookup to enterprise, organization or user accounts.
+	// Installation paths like github.com/enterprises/acme imply enterprise.
+	InstallationType *string `json:"installation_type,omitempty"`
+
+	// Preflight if set to true - checks requested permissions against the installation before requesting a token.
+	Preflight *bool `json:"preflight,omitempty"`
+
+	// ClampPermissions if set to true - reduces requested permissions to what the installation has.
+	// Implies Preflight.
+	ClampPermissions *bool `json:"clamp_permissions,omitempty"`
+
+	// OnPermissionMismatch is what to do when the token granted differs from the request: ignore (default), warn or fail.
+	OnPermissionMismatch *string `json:"on_permission_mismatch,omitempty"`
+
+	// OnNoMatch is what to do when no installation was found for the request: silent, fail or delegate.
+	// If not set, it is left to the caller.
+	OnNoMatch *string `json:"on_no_match,omitempty"`
+
+	// DelegateHelper is a credential helper to delegate to with OnNoMatch delegate, as in git's credential.helper.
+	DelegateHelper *string `json:"delegate_helper,omitempty"`
+
+	// CAFile is a PEM bundle to trust in addition to the system roots, overrides the global setting.
+	CAFile *string `json:"ca_file,omitempty"`
+
+	// ClientCert is a PEM client certificate for mTLS, overrides the global setting.
+	ClientCert *string `json:"client_cert,omitempty"`
+
+	// ClientKey is a PEM key for ClientCert, overrides the global setting.
+	ClientKey *string `json:"client_key,omitempty"`
+
+	// Proxy is an HTTP(S) proxy URL for GitHub API requests, overrides the global setting.
+	Proxy *string `json:"proxy,omitempty"`
+
+	// InsecureSkipVerify if set to true - disables TLS certificate verification, overrides the global setting.
+	InsecureSkipVerify *bool `json:"insecure_skip_verify,omitempty"`
+
+	// When restricts the rule to an environment, e.g. CI or a specific machine.
+	// If the conditions are not met, the rule is skipped as if its filter did not match.
+	When *When `json:"when,omitempty"`
+
+	// RequestedPermissions keeps Permissions as configured, when preflight clamps them.
+	RequestedPermissions *json.RawMessage `json:"-"`
+
+	// Rule is this config as configured, before repositories and permissions were augmented for a request.
+	// Tokens are cached under the augmented request, the rule only maps to them for CachedToken.
+	Rule *Config `json:"-"`
+
 	// ResolvedOwner is derived at runtime for cache keys; it is not part of config JSON.
 	ResolvedOwner string `json:"-"`
 }
 
+type Options struct {
+	// JWTIssuedAtDrift is how far back the JWT iat claim is dated to tolerate clock drift, a minute if nil.
+	JWTIssuedAtDrift *time.Duration
+
+	// JWTExpirationDrift is subtracted from the maximum JWT lifetime to tolerate clock drift, a minute if nil.
+	JWTExpirationDrift *time.Duration
+
+	// HTTPTimeout limits each individual GitHub API request.
+	HTTPTimeout time.Duration
+
+	// UserAgent is sent with every GitHub API request.
+	UserAgent string
+
+	// Retry controls retries of transient GitHub API failures.
+	Retry github.RetryPolicy
+
+	// Transport is the default proxy and TLS settings, each rule may override them.
+	Transport github.TransportOptions
+
+	// RateLimitWarnThreshold prints a warning when fewer GitHub API requests remain in the rate limit, zero disables it.
+	RateLimitWarnThreshold int
+
+	// APIVersion is a REST API version to send with every request, or "auto" to detect it from the server.
+	// Empty means no version is sent.
+	APIVersion string
+}
+
+var options Options
+
+func Configure(opts Options) {
+	options = opts
+	if options.JWTIssuedAtDrift == nil {
+		defaultDrift := time.Minute
+		options.JWTIssuedAtDrift = &defaultDrift
+	}
+	if options.JWTExpirationDrift == nil {
+		defaultDrift := time.Minute
+		options.JWTExpirationDrift = &defaultDrift
+	}
+	if options.HTTPTimeout == 0 {
+		options.HTTPTimeout = 30 * time.Second
+	}
+	if options.UserAgent == "" {
+		options.UserAgent = github.DefaultUserAgent
+	}
+	if options.Retry.MaxAttempts == 0 {
+		options.Retry.MaxAttempts = 3
+	}
+	if options.Retry.MaxWait == 0 {
+		options.Retry.MaxWait = time.Minute
+	}
+}
+
+func init() {
+	Configure(Options{})
+}
+
+// tokenExpiryMargin is how long before its expiry a cached token is no longer served.
+const tokenExpiryMargin = 5 * time.Minute
+
+// apiVersionTTL is how long the detected API version is cached, servers are not upgraded often.
+const apiVersionTTL = 24 * time.Hour
+
 type Helper struct {
 	configs map[string]Config
+	jwts    *jwtSources
 }
 
 type IHelper interface {
-	GetToken() (string, error)
+	GetToken(ctx context.Context) (*github.AppInstallationAccessToken, error)
+
+	// CachedToken returns a token from cache without calling GitHub API, or nil if there is none.
+	CachedToken() (*github.AppInstallationAccessToken, error)
+
+	// RevokeToken revokes the token and makes sure cache never serves it again.
+	RevokeToken(ctx context.Context, token string) error
+
+	// EvictToken drops the token from cache without revoking it, so the next request gets a new one.
+	// Returns false if the token was not cached, i.e. it was not issued by the trampoline with caching enabled.
+	EvictToken(token string) (bool, error)
+
+	// CredentialInput is the credential helper input for the request, as passed to a delegate.
+	CredentialInput() []byte
+
+	// Relay passes a git credential action (store or erase) to the delegate of the rule,
+	// if the rule delegates requests it has no installation for. Returns false if the trampoline serves the request.
+	Relay(ctx context.Context, action string, stdout, stderr io.Writer) (bool, error)
+
+	// Installations lists all installations of the app.
+	Installations(ctx context.Context) ([]github.AppInstallation, error)
+
+	// InstallationRepositories lists repositories accessible to the installation for the owner.
+	InstallationRepositories(ctx context.Context, owner string) ([]github.Repository, error)
+
+	// InspectToken reports what the token can do, without exposing the token itself.
+	InspectToken(ctx context.Context, token string) (*TokenInfo, error)
 }
 
 type GitHelper struct {
 	currentRepo string
+	input       []byte
 	config      Config
+	jwts        *jwtSources
 }
 
 type CLIHelper struct {
 	config Config
+	jwts   *jwtSources
 }
 
 func New(cfg string) *Helper {
@@ -87,11 +253,16 @@ func New(cfg string) *Helper {
 	if err := json.Unmarshal([]byte(cfg), &configs); err != nil {
 		panic(err)
 	}
-	return &Helper{configs: configs}
+	return &Helper{configs: configs, jwts: newJWTSources()}
 }
 
 func (h Helper) GitHelper(currentRepo string) (IHelper, error) {
-	configPtr := func(c map[string]Config) *Config {
+	return h.GitCredentialHelper(currentRepo, nil)
+}
+
+// GitCredentialHelper is GitHelper for a request from git, input is what git sent - it is passed to delegates as is.
+func (h Helper) GitCredentialHelper(currentRepo string, input []byte) (IHelper, error) {
+	configPtr, err := func(c map[string]Config) (*Config, error) {
 		currentRepoBytes := []byte(currentRepo)
 		filters := make([]string, 0, len(c))
 		for filter := range c {
@@ -109,15 +280,27 @@ func (h Helper) GitHelper(currentRepo string) (IHelper, error) {
 			if err != nil {
 				panic(err)
 			}
-			if matched {
-				logger.Get().Printf("Matched %q with %q", currentRepo, filter)
-				return &config
+			if !matched {
+				continue
 			}
+			conditions, err := config.When.Matches()
+			if err != nil {
+				return nil, err
+			}
+			if !conditions {
+				logger.Get().Printf("Matched %q with %q, but its when conditions are not met", currentRepo, filter)
+				continue
+			}
+			logger.Get().Printf("Matched %q with %q", currentRepo, filter)
+			return &config, nil
 		}
 
 		logger.Get().Printf("Can't match %s with anything", currentRepo)
-		return nil
+		return nil, nil
 	}(h.configs)
+	if err != nil {
+		return nil, err
+	}
 
 	if configPtr == nil {
 		return nil, &SilentExitError{Err: fmt.Errorf("Can't match %s with anything", currentRepo)}
@@ -137,7 +320,7 @@ func (h Helper) GitHelper(currentRepo string) (IHelper, error) {
 		config.Repositories = &repos
 	}
 
-	return GitHelper{currentRepo: currentRepo, config: config}, nil
+	return GitHelper{currentRepo: currentRepo, input: input, config: config, jwts: h.jwts}, nil
 }
 
 func (h Helper) CLIHelper() (IHelper, error) {
@@ -152,49 +335,155 @@ func (h Helper) CLIHelper() (IHelper, error) {
 		panic("Can't get first entry in a map of exactly one element - can't ever happen")
 	}(h.configs)
 
-	if config.CurrentRepositoryOnly != nil && *config.CurrentRepositoryOnly {
-		return nil, fmt.Errorf("Can't infer current repository in CLI mode")
+	return CLIHelper{config: config, jwts: h.jwts}, nil
+}
+
+func (h GitHelper) GetToken(ctx context.Context) (*github.AppInstallationAccessToken, error) {
+	token, err := h.issueToken(ctx)
+	return onNoMatch(ctx, h.config, h.CredentialInput(), token, err)
+}
+
+func (h GitHelper) issueToken(ctx context.Context) (*github.AppInstallationAccessToken, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
 	}
 
-	if config.Installation == nil && config.InstallationID == nil {
-		return nil, fmt.Errorf("Either installation or installation ID must be specified in CLI mode")
+	client, err := newClient(ctx, h.config)
+	if err != nil {
+		return nil, err
+	}
+	rule := h.config
+	h.config.Rule = &rule
+	token, err := withClockSkewRetry(h.jwts.get(h.config), func(jwt *jwtSource) (*github.AppInstallationAccessToken, error) {
+		if err := validateInstallationID(ctx, client, &h.config, jwt, h.currentRepo); err != nil {
+			return nil, err
+		}
+
+		if err := selectRepositories(ctx, client, &h.config, jwt); err != nil {
+			return nil, err
+		}
+
+		if err := includeSubmodules(ctx, client, &h.config, jwt, h.currentRepo); err != nil {
+			return nil, err
+		}
+
+		if err := prepareRepositories(ctx, client, &h.config, jwt); err != nil {
+			return nil, err
+		}
+
+		if err := preflightPermissions(ctx, client, &h.config, jwt); err != nil {
+			return nil, err
+		}
+
+		return getTokenWithRetry(ctx, client, &h.config, jwt, h.currentRepo)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPermissions(ctx, h.config, token); err != nil {
+		return nil, err
 	}
 
-	return CLIHelper{config: config}, nil
+	return token, nil
+}
+
+func (h CLIHelper) GetToken(ctx context.Context) (*github.AppInstallationAccessToken, error) {
+	token, err := h.issueToken(ctx)
+	return onNoMatch(ctx, h.config, h.CredentialInput(), token, err)
 }
 
-func (h GitHelper) GetToken() (string, error) {
+func (h CLIHelper) issueToken(ctx context.Context) (*github.AppInstallationAccessToken, error) {
 	if err := validateConfig(&h.config); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if h.config.CurrentRepositoryOnly != nil && *h.config.CurrentRepositoryOnly {
+		return nil, fmt.Errorf("Can't infer current repository in CLI mode")
 	}
 
-	jwt, err := github.CreateJWT(h.config.PrivateKey, h.config.AppID)
+	if h.config.Installation == nil && h.config.InstallationID == nil {
+		return nil, fmt.Errorf("Either installation or installation ID must be specified in CLI mode")
+	}
+
+	client, err := newClient(ctx, h.config)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	rule := h.config
+	h.config.Rule = &rule
+	token, err := withClockSkewRetry(h.jwts.get(h.config), func(jwt *jwtSource) (*github.AppInstallationAccessToken, error) {
+		if err := validateInstallationID(ctx, client, &h.config, jwt, ""); err != nil {
+			return nil, err
+		}
 
-	if err := validateInstallationID(&h.config, jwt, h.currentRepo); err != nil {
-		return "", err
+		if err := selectRepositories(ctx, client, &h.config, jwt); err != nil {
+			return nil, err
+		}
+
+		if err := includeSubmodules(ctx, client, &h.config, jwt, ""); err != nil {
+			return nil, err
+		}
+
+		if err := prepareRepositories(ctx, client, &h.config, jwt); err != nil {
+			return nil, err
+		}
+
+		if err := preflightPermissions(ctx, client, &h.config, jwt); err != nil {
+			return nil, err
+		}
+
+		return getTokenWithRetry(ctx, client, &h.config, jwt, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPermissions(ctx, h.config, token); err != nil {
+		return nil, err
 	}
 
-	return getTokenWithRetry(&h.config, jwt, h.currentRepo)
+	return token, nil
 }
 
-func (h CLIHelper) GetToken() (string, error) {
+func (h GitHelper) CachedToken() (*github.AppInstallationAccessToken, error) {
 	if err := validateConfig(&h.config); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	jwt, err := github.CreateJWT(h.config.PrivateKey, h.config.AppID)
-	if err != nil {
-		return "", err
+	return cachedToken(&h.config, h.currentRepo)
+}
+
+func (h CLIHelper) CachedToken() (*github.AppInstallationAccessToken, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
 	}
 
-	if err := validateInstallationID(&h.config, jwt, ""); err != nil {
-		return "", err
+	return cachedToken(&h.config, "")
+}
+
+func (h GitHelper) RevokeToken(ctx context.Context, token string) error {
+	if err := validateConfig(&h.config); err != nil {
+		return err
 	}
 
-	return getTokenWithRetry(&h.config, jwt, "")
+	return revokeToken(ctx, h.config, token)
+}
+
+func (h CLIHelper) RevokeToken(ctx context.Context, token string) error {
+	if err := validateConfig(&h.config); err != nil {
+		return err
+	}
+
+	return revokeToken(ctx, h.config, token)
+}
+
+func (h GitHelper) EvictToken(token string) (bool, error) {
+	return evictToken(token)
+}
+
+func (h CLIHelper) EvictToken(token string) (bool, error) {
+	return evictToken(token)
 }
 
 func validateConfig(config *Config) error {
@@ -215,44 +504,133 @@ func validateConfig(config *Config) error {
 		logger.Get().Printf("API URL was calculated automatically to %q", api)
 		config.GitHubAPI = &api
 	}
+	// Cache keys are built from the API URL, so it must be the same however it was written.
+	api := strings.TrimSuffix(*config.GitHubAPI, "/")
+	config.GitHubAPI = &api
 
 	if config.PrivateKey == "" {
 		return fmt.Errorf("Private Key was not set")
 	}
 
-	if config.AppID <= 0 {
-		return fmt.Errorf("GitHub App ID was not set")
+	if config.AppID <= 0 && config.ClientID == "" {
+		return fmt.Errorf("Neither GitHub App ID nor Client ID was set")
 	}
 
 	if config.CurrentOwnerOnly != nil && *config.CurrentOwnerOnly && config.CurrentRepositoryOnly != nil && *config.CurrentRepositoryOnly {
 		return fmt.Errorf("current_owner conflicts with current_repo")
 	}
 
+	if err := validateInstallationType(config); err != nil {
+		return err
+	}
+
+	if err := validateRepositorySelector(config); err != nil {
+		return err
+	}
+
+	if err := config.When.compile(); err != nil {
+		return err
+	}
+
+	if config.OnPermissionMismatch != nil {
+		switch *config.OnPermissionMismatch {
+		case OnPermissionMismatchIgnore, OnPermissionMismatchWarn, OnPermissionMismatchFail:
+		default:
+			return fmt.Errorf("on_permission_mismatch must be one of %s, %s or %s, got: %q", OnPermissionMismatchIgnore, OnPermissionMismatchWarn, OnPermissionMismatchFail, *config.OnPermissionMismatch)
+		}
+	}
+
+	if config.OnNoMatch != nil {
+		switch *config.OnNoMatch {
+		case OnNoMatchSilent, OnNoMatchFail:
+		case OnNoMatchDelegate:
+			if config.DelegateHelper == nil || strings.TrimSpace(*config.DelegateHelper) == "" {
+				return fmt.Errorf("on_no_match %s requires delegate_helper to be set", OnNoMatchDelegate)
+			}
+		default:
+			return fmt.Errorf("on_no_match must be one of %s, %s or %s, got: %q", OnNoMatchSilent, OnNoMatchFail, OnNoMatchDelegate, *config.OnNoMatch)
+		}
+	}
+
 	return nil
 }
 
-func validateInstallationID(config *Config, jwt, currentRepo string) error {
+func newClient(ctx context.Context, config Config) (*github.Client, error) {
+	transport := options.Transport
+	if config.CAFile != nil {
+		transport.CAFile = *config.CAFile
+	}
+	if config.ClientCert != nil {
+		transport.ClientCert = *config.ClientCert
+	}
+	if config.ClientKey != nil {
+		transport.ClientKey = *config.ClientKey
+	}
+	if config.Proxy != nil {
+		transport.Proxy = *config.Proxy
+	}
+	if config.InsecureSkipVerify != nil {
+		transport.InsecureSkipVerify = *config.InsecureSkipVerify
+	}
+	apiVersion := options.APIVersion
+	if config.APIVersion != nil {
+		apiVersion = *config.APIVersion
+	}
+	client, err := github.NewClient(*config.GitHubAPI, github.ClientOptions{
+		Timeout:    options.HTTPTimeout,
+		UserAgent:  options.UserAgent,
+		Retry:      options.Retry,
+		Transport:  transport,
+		APIVersion: apiVersion,
+
+		RateLimitWarnThreshold: options.RateLimitWarnThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if apiVersion == github.APIVersionAuto {
+		if client.APIVersion, err = detectAPIVersionWithCache(ctx, client, *config.GitHubAPI); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// detectAPIVersionWithCache resolves the "auto" API version, remembering it per API URL.
+// If /meta fails, the default version is used rather than failing the request.
+func detectAPIVersionWithCache(ctx context.Context, client *github.Client, api string) (string, error) {
+	key := apiVersionCacheKey(api)
+	var version string
+	if hit, err := cache.Get(key, &version); err != nil {
+		return "", err
+	} else if hit {
+		return version, nil
+	}
+	version, err := client.DetectAPIVersion(ctx)
+	if err != nil {
+		// Not remembered, so detection is attempted again next time.
+		logger.Warnf("Can't detect API version, assuming %s: %s", github.DefaultAPIVersion, err)
+		return github.DefaultAPIVersion, nil
+	}
+	_ = cache.Set(key, version, apiVersionTTL)
+	return version, nil
+}
+
+func appCacheKey(config Config) string {
+	if config.ClientID != "" {
+		return fmt.Sprintf("client_id=%s", config.ClientID)
+	}
+	return fmt.Sprintf("app=%d", config.AppID)
+}
+
+func validateInstallationID(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource, currentRepo string) error {
 	if config.InstallationID == nil {
 		logger.Get().Printf("Installation ID was not provided, calculating automatically...")
 
-		var owner string
-		if config.Installation != nil {
-			logger.Get().Printf("Looking up installation ID for %s", *config.Installation)
-			split := strings.Split(*config.Installation, "/")
-			if len(split) > 2 {
-				owner = split[len(split)-2]
-			} else {
-				owner = split[1]
-			}
-		} else if currentRepo != "" {
-			logger.Get().Printf("Looking up installation for current repo %s", currentRepo)
-			split := strings.Split(currentRepo, "/")
-			owner = split[len(split)-2]
-		} else {
-			return &SilentExitError{Err: fmt.Errorf("Can't find an owner for automatic installation ID lookup")}
+		owner, repo, err := installationOwner(config, currentRepo)
+		if err != nil {
+			return err
 		}
-		logger.Get().Printf("Owner determined %q", owner)
-		config.ResolvedOwner = owner
 
 		if cache.Enabled() {
 			if cachedID, ok, err := getCachedInstallationID(config, owner); err != nil {
@@ -263,57 +641,242 @@ func validateInstallationID(config *Config, jwt, currentRepo string) error {
 			}
 		}
 
-		logger.Get().Printf("Getting installation IDs")
-		installations, _, err := getInstallationsWithCache(*config.GitHubAPI, jwt, config.AppID)
+		installation, err := lookupInstallation(ctx, client, jwt, owner, repo, installationType(*config))
 		if err != nil {
 			return err
 		}
 
-		logger.Get().Printf("Matching installation ID for owner=%q", owner)
-		installationPtr := func(installations []github.AppInstallation, owner string) *github.AppInstallation {
-			for i := range installations {
-				if installations[i].Account.Login == owner {
-					logger.Get().Printf("Matched owner %q with ID %d", owner, installations[i].ID)
-					return &installations[i]
-				}
-			}
-
-			return nil
-		}(installations, owner)
-
-		if installationPtr == nil {
-			if cache.Enabled() {
-				refreshInstallationsCache(config)
-				installations, _, err = getInstallationsWithCache(*config.GitHubAPI, jwt, config.AppID)
-				if err != nil {
-					return err
-				}
-				installationPtr = func(installations []github.AppInstallation, owner string) *github.AppInstallation {
-					for i := range installations {
-						if installations[i].Account.Login == owner {
-							logger.Get().Printf("Matched owner %q with ID %d", owner, installations[i].ID)
-							return &installations[i]
-						}
-					}
-					return nil
-				}(installations, owner)
-			}
-			if installationPtr == nil {
-				return &SilentExitError{Err: fmt.Errorf("Can't find an installation ID for owner %s", owner)}
-			}
+		if installation == nil && installationType(*config) == InstallationTypeEnterprise {
+			installation, err = listInstallation(ctx, client, config, jwt, owner)
+		} else if installation == nil {
+			// Direct lookups are definitive, unless the owner was renamed since.
+			installation, err = matchRenamedOwner(ctx, client, config, jwt, owner, repo)
+		}
+		if err != nil {
+			return err
+		}
+		if installation == nil {
+			return &SilentExitError{Err: fmt.Errorf("Can't find an installation ID for owner %s", owner)}
+		}
+		if err := checkSuspended(installation); err != nil {
+			return err
 		}
-		installation := *installationPtr
 
 		config.InstallationID = &installation.ID
 		if cache.Enabled() {
 			setCachedInstallationID(config, owner, installation.ID)
+			setCachedOwnerAccountID(config, owner, installation.Account.ID)
 		}
 	}
 
 	return nil
 }
 
-func getToken(config Config, jwt string) (string, error) {
+// checkSuspended returns an InstallationSuspendedError if the installation was suspended by its owner.
+func checkSuspended(installation *github.AppInstallation) error {
+	if installation.SuspendedAt == nil {
+		return nil
+	}
+	return &github.InstallationSuspendedError{
+		InstallationID: installation.ID,
+		Account:        installation.Account.Handle(),
+		SuspendedAt:    *installation.SuspendedAt,
+	}
+}
+
+// installationOwner determines the owner (and repository, if known) to look up the installation for.
+func installationOwner(config *Config, currentRepo string) (string, string, error) {
+	var owner, repo string
+	if config.Installation != nil {
+		logger.Get().Printf("Looking up installation ID for %s", *config.Installation)
+		split := strings.Split(*config.Installation, "/")
+		// With installation_type organization or user, server/enterprises/slug is a repository of an owner named "enterprises".
+		if installationType(*config) == InstallationTypeEnterprise && isEnterprisePath(*config.Installation) {
+			owner = split[2]
+		} else if len(split) > 2 {
+			owner = split[len(split)-2]
+			repo = split[len(split)-1]
+		} else {
+			owner = split[1]
+		}
+	} else if installationType(*config) == InstallationTypeEnterprise {
+		return "", "", fmt.Errorf("installation_type %s requires installation to be set to a path like github.com/enterprises/<slug>", InstallationTypeEnterprise)
+	} else if currentRepo != "" {
+		logger.Get().Printf("Looking up installation for current repo %s", currentRepo)
+		split := strings.Split(currentRepo, "/")
+		owner = split[len(split)-2]
+		repo = split[len(split)-1]
+	} else {
+		return "", "", &SilentExitError{Err: fmt.Errorf("Can't find an owner for automatic installation ID lookup")}
+	}
+	logger.Get().Printf("Owner determined %q", owner)
+	config.ResolvedOwner = owner
+	return owner, repo, nil
+}
+
+// lookupInstallation resolves an installation directly via the repository, organization or user endpoint.
+// Returns nil if none of them found it. Enterprise installations have no such endpoint and are always listed instead.
+func lookupInstallation(ctx context.Context, client *github.Client, jwt *jwtSource, owner, repo, installationType string) (*github.AppInstallation, error) {
+	if installationType == InstallationTypeEnterprise {
+		return nil, nil
+	}
+
+	signed, err := jwt.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	lookups := []func() (*github.AppInstallation, error){}
+	if installationType != InstallationTypeUser {
+		lookups = append(lookups, func() (*github.AppInstallation, error) {
+			return client.GetOrganizationInstallation(ctx, signed, owner)
+		})
+	}
+	if installationType != InstallationTypeOrganization {
+		lookups = append(lookups, func() (*github.AppInstallation, error) {
+			return client.GetUserInstallation(ctx, signed, owner)
+		})
+	}
+	if repo != "" {
+		lookups = append([]func() (*github.AppInstallation, error){
+			func() (*github.AppInstallation, error) {
+				return client.GetRepositoryInstallation(ctx, signed, owner, repo)
+			},
+		}, lookups...)
+	}
+
+	for _, lookup := range lookups {
+		installation, err := lookup()
+		if err == nil && !matchesInstallationType(*installation, installationType) {
+			logger.Get().Printf("Skipping installation %d of type %q, looking for %q", installation.ID, installation.TargetType, installationType)
+			continue
+		}
+		if err == nil {
+			logger.Get().Printf("Matched owner %q with ID %d", owner, installation.ID)
+			return installation, nil
+		}
+		if !github.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// listInstallation finds an installation for the owner by listing all installations of the app.
+// Only enterprise installations need it, as they have no direct lookup endpoint.
+func listInstallation(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource, owner string) (*github.AppInstallation, error) {
+	logger.Get().Printf("Getting installation IDs")
+	installations, _, err := getInstallationsWithCache(ctx, client, *config, jwt)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Get().Printf("Matching installation ID for owner=%q", owner)
+	installation := matchInstallation(installations, owner, installationType(*config))
+
+	if installation == nil && cache.Enabled() {
+		refreshInstallationsCache(config)
+		installations, _, err = getInstallationsWithCache(ctx, client, *config, jwt)
+		if err != nil {
+			return nil, err
+		}
+		installation = matchInstallation(installations, owner, installationType(*config))
+	}
+	return installation, nil
+}
+
+// matchRenamedOwner looks for the installation of an owner the direct lookups did not find, in case it was renamed.
+// If the owner was seen before, installations are listed and matched by the account ID it was last seen with,
+// which the installation list keeps across renames. Otherwise the owner is resolved via the repository or
+// the account endpoint, which follow renames, and looked up directly under its new name.
+// Returns nil if there is no evidence of a rename - that is a definitive miss, and never fails the request on its own.
+func matchRenamedOwner(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource, owner, repo string) (*github.AppInstallation, error) {
+	logger.Get().Printf("Direct lookup did not find an installation for owner=%q, checking if it was renamed", owner)
+
+	if accountID := getCachedOwnerAccountID(config, owner); accountID != 0 {
+		installations, _, err := getInstallationsWithCache(ctx, client, *config, jwt)
+		if err != nil {
+			return nil, err
+		}
+		for i := range installations {
+			if installations[i].Account.ID == accountID && matchesInstallationType(installations[i], installationType(*config)) {
+				logger.Get().Printf("Owner %q is now %q, matched with ID %d", owner, installations[i].Account.Handle(), installations[i].ID)
+				return &installations[i], nil
+			}
+		}
+		return nil, nil
+	}
+
+	account := resolveOwnerAccount(ctx, client, owner, repo)
+	if account == nil || account.ID == 0 || account.Login == "" || strings.EqualFold(account.Login, owner) {
+		logger.Get().Printf("Owner %q was not renamed", owner)
+		return nil, nil
+	}
+	logger.Get().Printf("Owner %q is now %q", owner, account.Login)
+	installation, err := lookupInstallation(ctx, client, jwt, account.Login, repo, installationType(*config))
+	if err != nil || installation == nil {
+		return nil, err
+	}
+	if installation.Account.ID != account.ID {
+		logger.Get().Printf("Installation %d belongs to account %d, not %d", installation.ID, installation.Account.ID, account.ID)
+		return nil, nil
+	}
+	return installation, nil
+}
+
+// resolveOwnerAccount asks the unauthenticated repository or account endpoint for the current account of the owner.
+// Any error means the owner can't be resolved this way; it is logged and nil is returned.
+func resolveOwnerAccount(ctx context.Context, client *github.Client, owner, repo string) *github.AppInstallationAccount {
+	if repo != "" {
+		repository, err := client.GetRepository(ctx, owner, repo)
+		if err != nil {
+			logger.Get().Printf("Can't resolve repository %s/%s: %s", owner, repo, err)
+		} else if repository.Owner != nil && repository.Owner.ID != 0 {
+			return repository.Owner
+		}
+	}
+	account, err := client.GetAccount(ctx, owner)
+	if err != nil {
+		logger.Get().Printf("Can't resolve account %s: %s", owner, err)
+		return nil
+	}
+	return account
+}
+
+func matchInstallation(installations []github.AppInstallation, owner, installationType string) *github.AppInstallation {
+	for i := range installations {
+		if matchesInstallation(installations[i], owner, installationType) {
+			logger.Get().Printf("Matched owner %q with ID %d", owner, installations[i].ID)
+			return &installations[i]
+		}
+	}
+	return nil
+}
+
+func getToken(ctx context.Context, client *github.Client, config Config, jwt *jwtSource) (*github.AppInstallationAccessToken, error) {
+	requestData, err := tokenRequest(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache.Enabled() {
+		return getTokenWithCache(ctx, client, config, jwt, requestData)
+	}
+
+	signed, err := jwt.Token()
+	if err != nil {
+		return nil, err
+	}
+	token, err := client.GetToken(ctx, signed, *config.InstallationID, requestData)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func tokenRequest(config Config) ([]byte, error) {
 	logger.Get().Printf("Building token request")
 
 	request := map[string]interface{}{}
@@ -332,115 +895,152 @@ func getToken(config Config, jwt string) (string, error) {
 		logger.Get().Printf("Enabled: permissions")
 		permissions := map[string]interface{}{}
 		if err := json.Unmarshal(*config.Permissions, &permissions); err != nil {
-			return "", err
+			return nil, err
 		}
 		request["permissions"] = permissions
 	}
 
-	requestData, err := json.MarshalIndent(request, "", "    ")
-	if err != nil {
-		return "", err
-	}
-
-	if cache.Enabled() {
-		return getTokenWithCache(config, jwt, requestData)
-	}
-
-	token, err := github.GetToken(*config.GitHubAPI, jwt, *config.InstallationID, requestData)
-	if err != nil {
-		return "", err
-	}
-
-	return token.Token, nil
+	return json.MarshalIndent(request, "", "    ")
 }
 
-func getTokenWithRetry(config *Config, jwt, currentRepo string) (string, error) {
-	token, err := getToken(*config, jwt)
+func getTokenWithRetry(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource, currentRepo string) (*github.AppInstallationAccessToken, error) {
+	token, err := getToken(ctx, client, *config, jwt)
 	if err == nil {
 		return token, nil
 	}
 	if !cache.Enabled() {
-		return "", err
+		return nil, err
+	}
+	if _, ok := github.ClockSkew(err); ok {
+		return nil, err
 	}
 	var apiErr *github.APIError
 	if !errors.As(err, &apiErr) {
-		return "", err
+		return nil, err
 	}
 	if apiErr.Status != 401 && apiErr.Status != 404 {
-		return "", err
+		return nil, err
 	}
 
 	logger.Get().Printf("Token request failed with status=%d, invalidating installation caches and retrying", apiErr.Status)
 	invalidateInstallationCaches(config)
 	config.InstallationID = nil
-	if err := validateInstallationID(config, jwt, currentRepo); err != nil {
-		return "", err
+	if err := validateInstallationID(ctx, client, config, jwt, currentRepo); err != nil {
+		return nil, err
+	}
+	if err := preflightPermissions(ctx, client, config, jwt); err != nil {
+		return nil, err
 	}
 
-	return getToken(*config, jwt)
+	return getToken(ctx, client, *config, jwt)
 }
 
-func getTokenWithCache(config Config, jwt string, requestData []byte) (string, error) {
+func getTokenWithCache(ctx context.Context, client *github.Client, config Config, jwt *jwtSource, requestData []byte) (*github.AppInstallationAccessToken, error) {
 	tokenKey := tokenCacheKey(config, requestData)
-	var cachedToken string
-	if hit, err := cache.Get(tokenKey, &cachedToken); err != nil {
-		return "", err
-	} else if hit && cachedToken != "" {
-		return cachedToken, nil
+	if cachedToken, err := getCachedToken(tokenKey); err != nil || cachedToken != nil {
+		return cachedToken, err
 	}
 
 	var token *github.AppInstallationAccessToken
 	err := cache.WithLock(tokenKey, func() error {
-		if hit, err := cache.Get(tokenKey, &cachedToken); err != nil {
+		cachedToken, err := getCachedToken(tokenKey)
+		if err != nil {
 			return err
-		} else if hit && cachedToken != "" {
+		} else if cachedToken != nil {
+			token = cachedToken
 			return nil
 		}
-		fetched, err := github.GetToken(*config.GitHubAPI, jwt, *config.InstallationID, requestData)
+		signed, err := jwt.Token()
+		if err != nil {
+			return err
+		}
+		fetched, err := client.GetToken(ctx, signed, *config.InstallationID, requestData)
 		if err != nil {
 			return err
 		}
 		token = fetched
-		return cache.Set(tokenKey, token.Token, cache.TTLToken())
+		setCachedTokenInfo(token)
+		_ = cache.Set(tokenIndexCacheKey(token.Token), tokenKey, tokenCacheTTL(token))
+		if ruleKey, err := ruleTokenCacheKey(config); err == nil && ruleKey != tokenKey {
+			_ = cache.Set(ruleKey, tokenKey, tokenCacheTTL(token))
+		}
+		return cache.Set(tokenKey, token, tokenCacheTTL(token))
 	})
 	if err != nil {
-		return "", err
-	}
-	if cachedToken != "" {
-		return cachedToken, nil
+		return nil, err
 	}
 	if token == nil {
-		if hit, err := cache.Get(tokenKey, &cachedToken); err != nil {
-			return "", err
-		} else if hit && cachedToken != "" {
-			return cachedToken, nil
+		if cachedToken, err := getCachedToken(tokenKey); err != nil || cachedToken != nil {
+			return cachedToken, err
 		}
-		return "", fmt.Errorf("token was not cached")
+		return nil, fmt.Errorf("token was not cached")
 	}
-	return token.Token, nil
+	return token, nil
 }
 
-func getInstallationsWithCache(api, jwt string, appID int) ([]github.AppInstallation, bool, error) {
+// getCachedToken returns nil if there is no cached token for the key, or the cached one was revoked.
+func getCachedToken(tokenKey string) (*github.AppInstallationAccessToken, error) {
+	var cachedToken github.AppInstallationAccessToken
+	if hit, err := cache.Get(tokenKey, &cachedToken); err != nil {
+		return nil, err
+	} else if !hit || cachedToken.Token == "" {
+		return nil, nil
+	}
+	if isTokenRevoked(cachedToken.Token) {
+		logger.Get().Printf("Cached token %s was revoked, discarding", Fingerprint(cachedToken.Token)[:12])
+		cache.Delete(tokenKey)
+		return nil, nil
+	}
+	return &cachedToken, nil
+}
+
+// tokenCacheTTL keeps a token in cache for TTLToken, but never closer than tokenExpiryMargin to its expiry.
+func tokenCacheTTL(token *github.AppInstallationAccessToken) time.Duration {
+	ttl := cache.TTLToken()
+	if token.ExpiresAt.IsZero() {
+		return ttl
+	}
+	if remaining := time.Until(token.ExpiresAt) - tokenExpiryMargin; remaining < ttl {
+		ttl = max(remaining, 0)
+	}
+	return ttl
+}
+
+// getInstallationsWithCache lists installations of the app, caching them per page.
+// Once the cache expires, pages are revalidated with their ETags, so unchanged pages do not count against the rate limit.
+func getInstallationsWithCache(ctx context.Context, client *github.Client, config Config, jwt *jwtSource) ([]github.AppInstallation, bool, error) {
 	if !cache.Enabled() {
-		installations, err := github.GetInstallations(api, jwt)
+		signed, err := jwt.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		installations, err := client.GetInstallations(ctx, signed)
 		return installations, false, err
 	}
 
-	key := installationsCacheKey(appID, api)
-	installations := []github.AppInstallation{}
-	if hit, err := cache.Get(key, &installations); err != nil {
+	key := installationsCacheKey(appCacheKey(config), *config.GitHubAPI)
+	pages := []github.InstallationsPage{}
+	if hit, err := cache.Get(key, &pages); err != nil {
 		return nil, false, err
 	} else if hit {
-		return installations, true, nil
+		return github.FlattenInstallationPages(pages), true, nil
 	}
-	var fetched []github.AppInstallation
+	var fetched []github.InstallationsPage
 	err := cache.WithLock(key, func() error {
-		if hit, err := cache.Get(key, &installations); err != nil {
+		if hit, err := cache.Get(key, &pages); err != nil {
 			return err
 		} else if hit {
 			return nil
 		}
-		resp, err := github.GetInstallations(api, jwt)
+		stale := []github.InstallationsPage{}
+		if _, err := cache.GetStale(key, &stale); err != nil {
+			return err
+		}
+		signed, err := jwt.Token()
+		if err != nil {
+			return err
+		}
+		resp, err := client.GetInstallationPages(ctx, signed, stale)
 		if err != nil {
 			return err
 		}
@@ -450,22 +1050,14 @@ func getInstallationsWithCache(api, jwt string, appID int) ([]github.AppInstalla
 	if err != nil {
 		return nil, false, err
 	}
-	if len(installations) > 0 {
-		return installations, true, nil
-	}
 	if fetched != nil {
-		return fetched, false, nil
+		return github.FlattenInstallationPages(fetched), false, nil
 	}
-	if hit, err := cache.Get(key, &installations); err != nil {
-		return nil, false, err
-	} else if hit {
-		return installations, true, nil
-	}
-	return []github.AppInstallation{}, false, nil
+	return github.FlattenInstallationPages(pages), true, nil
 }
 
 func getCachedInstallationID(config *Config, owner string) (int, bool, error) {
-	key := ownerCacheKey(config.AppID, *config.GitHubAPI, owner)
+	key := ownerCacheKey(appCacheKey(*config), *config.GitHubAPI, owner, installationType(*config))
 	var cachedID int
 	hit, err := cache.Get(key, &cachedID)
 	if err != nil {
@@ -474,10 +1066,10 @@ func getCachedInstallationID(config *Config, owner string) (int, bool, error) {
 	if !hit || cachedID == 0 {
 		return 0, false, nil
 	}
-	installationsKey := installationsCacheKey(config.AppID, *config.GitHubAPI)
-	installations := []github.AppInstallation{}
-	if listHit, err := cache.Get(installationsKey, &installations); err == nil && listHit {
-		if !installationIDMatchesOwner(installations, owner, cachedID) {
+	installationsKey := installationsCacheKey(appCacheKey(*config), *config.GitHubAPI)
+	pages := []github.InstallationsPage{}
+	if listHit, err := cache.Get(installationsKey, &pages); err == nil && listHit {
+		if !installationIDMatchesOwner(github.FlattenInstallationPages(pages), owner, installationType(*config), cachedID, getCachedOwnerAccountID(config, owner)) {
 			cache.Delete(key)
 			refreshInstallationsCache(config)
 			return 0, false, nil
@@ -487,26 +1079,52 @@ func getCachedInstallationID(config *Config, owner string) (int, bool, error) {
 }
 
 func setCachedInstallationID(config *Config, owner string, id int) {
-	key := ownerCacheKey(config.AppID, *config.GitHubAPI, owner)
+	key := ownerCacheKey(appCacheKey(*config), *config.GitHubAPI, owner, installationType(*config))
 	_ = cache.Set(key, id, cache.TTLOwnerMapping())
 }
 
-func installationIDMatchesOwner(installations []github.AppInstallation, owner string, id int) bool {
+// installationIDMatchesOwner reports whether a cached installation ID for the owner is still valid.
+// If no installation matches the owner by name, it might have been renamed - then the installation
+// must still belong to the account the owner was last seen with.
+func installationIDMatchesOwner(installations []github.AppInstallation, owner, installationType string, id, accountID int) bool {
+	var installation *github.AppInstallation
 	for i := range installations {
-		if installations[i].Account.Login == owner {
+		if matchesInstallation(installations[i], owner, installationType) {
 			return installations[i].ID == id
 		}
+		if installations[i].ID == id {
+			installation = &installations[i]
+		}
 	}
-	return false
+	return installation != nil && accountID != 0 && installation.Account.ID == accountID
+}
+
+// getCachedOwnerAccountID returns the account ID the owner was last seen with, or 0.
+func getCachedOwnerAccountID(config *Config, owner string) int {
+	var accountID int
+	if hit, err := cache.Get(ownerAccountCacheKey(*config.GitHubAPI, owner), &accountID); err != nil || !hit {
+		return 0
+	}
+	return accountID
+}
+
+func setCachedOwnerAccountID(config *Config, owner string, accountID int) {
+	if accountID == 0 {
+		return
+	}
+	_ = cache.Set(ownerAccountCacheKey(*config.GitHubAPI, owner), accountID, cache.TTLOwnerMapping())
 }
 
 func refreshInstallationsCache(config *Config) {
 	if config == nil || config.GitHubAPI == nil {
 		return
 	}
-	cache.Delete(installationsCacheKey(config.AppID, *config.GitHubAPI))
+	cache.Delete(installationsCacheKey(appCacheKey(*config), *config.GitHubAPI))
 	if config.ResolvedOwner != "" {
-		cache.Delete(ownerCacheKey(config.AppID, *config.GitHubAPI, config.ResolvedOwner))
+		cache.Delete(ownerCacheKey(appCacheKey(*config), *config.GitHubAPI, config.ResolvedOwner, installationType(*config)))
+	}
+	if config.InstallationID != nil {
+		cache.Delete(installationCacheKey(appCacheKey(*config), *config.GitHubAPI, *config.InstallationID))
 	}
 }
 
@@ -514,12 +1132,64 @@ func invalidateInstallationCaches(config *Config) {
 	refreshInstallationsCache(config)
 }
 
-func installationsCacheKey(appID int, api string) string {
-	return fmt.Sprintf("installations:app=%d api=%s", appID, api)
+func apiVersionCacheKey(api string) string {
+	return fmt.Sprintf("api_version:api=%s", api)
+}
+
+func installationsCacheKey(app string, api string) string {
+	return fmt.Sprintf("installation_pages:%s api=%s", app, api)
+}
+
+func tokenInfoCacheKey(token string) string {
+	return fmt.Sprintf("token_info:fp=%s", Fingerprint(token))
+}
+
+// ruleTokenCacheKey maps the rule a token was requested for to the key it was cached under.
+func ruleTokenCacheKey(config Config) (string, error) {
+	if config.Rule == nil {
+		return "", fmt.Errorf("Rule is not set")
+	}
+	rule := *config.Rule
+	rule.InstallationID = config.InstallationID
+	rule.ResolvedOwner = ""
+	requestData, err := tokenRequest(rule)
+	if err != nil {
+		return "", err
+	}
+	return "token_rule:" + tokenCacheKey(rule, requestData), nil
+}
+
+func tokenIndexCacheKey(token string) string {
+	return fmt.Sprintf("token_index:fp=%s", Fingerprint(token))
+}
+
+func revokedCacheKey(token string) string {
+	return fmt.Sprintf("revoked:fp=%s", Fingerprint(token))
+}
+
+// installationRepositoriesCacheKey is versioned with the fields of github.Repository, as listings cached
+// before topics were added would otherwise never match a topics selector.
+func installationRepositoriesCacheKey(app string, api string, id int) string {
+	return fmt.Sprintf("installation_repos:v2:%s api=%s id=%d", app, api, id)
+}
+
+func installationCacheKey(app string, api string, id int) string {
+	return fmt.Sprintf("installation:%s api=%s id=%d", app, api, id)
+}
+
+func ownerCacheKey(app string, api, owner, installationType string) string {
+	if installationType != "" {
+		return fmt.Sprintf("owner_map:%s api=%s owner=%s type=%s", app, api, strings.ToLower(owner), installationType)
+	}
+	return fmt.Sprintf("owner_map:%s api=%s owner=%s", app, api, strings.ToLower(owner))
+}
+
+func ownerAccountCacheKey(api, owner string) string {
+	return fmt.Sprintf("owner_account:api=%s owner=%s", api, strings.ToLower(owner))
 }
 
-func ownerCacheKey(appID int, api, owner string) string {
-	return fmt.Sprintf("owner_map:app=%d api=%s owner=%s", appID, api, owner)
+func clockSkewCacheKey(api string) string {
+	return fmt.Sprintf("clock_skew:api=%s", api)
 }
 
 func tokenCacheKey(config Config, requestData []byte) string {
@@ -545,11 +1215,11 @@ func tokenCacheKey(config Config, requestData []byte) string {
 	}
 	ownerPart := "owner="
 	if config.ResolvedOwner != "" {
-		ownerPart = fmt.Sprintf("owner=%s", config.ResolvedOwner)
+		ownerPart = fmt.Sprintf("owner=%s", strings.ToLower(config.ResolvedOwner))
 	}
 	return fmt.Sprintf(
-		"token:app=%d api=%s installation=%d %s %s %s %s request=%s",
-		config.AppID,
+		"token:%s api=%s installation=%d %s %s %s %s request=%s",
+		appCacheKey(config),
 		*config.GitHubAPI,
 		*config.InstallationID,
 		ownerPart,
@@ -0,0 +1,108 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// TokenInfo is what is known about a token, it never contains the token itself.
+type TokenInfo struct {
+	Fingerprint string     `json:"fingerprint"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+
+	// Permissions and RepositorySelection are only known for tokens issued with caching enabled.
+	Permissions         map[string]string `json:"permissions,omitempty"`
+	RepositorySelection string            `json:"repository_selection,omitempty"`
+
+	Repositories []github.Repository `json:"repositories"`
+	RateLimit    *github.RateLimit   `json:"rate_limit,omitempty"`
+	Revoked      bool                `json:"revoked"`
+
+	// Valid is false if GitHub rejected the token - it expired or was revoked.
+	Valid bool `json:"valid"`
+}
+
+func (h GitHelper) InspectToken(ctx context.Context, token string) (*TokenInfo, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
+	}
+
+	return inspectToken(ctx, h.config, token)
+}
+
+func (h CLIHelper) InspectToken(ctx context.Context, token string) (*TokenInfo, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
+	}
+
+	return inspectToken(ctx, h.config, token)
+}
+
+func inspectToken(ctx context.Context, config Config, token string) (*TokenInfo, error) {
+	client, err := newClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TokenInfo{
+		Fingerprint: Fingerprint(token),
+		Revoked:     isTokenRevoked(token),
+	}
+	logger.Get().Printf("Inspecting token %s", info.Fingerprint[:12])
+
+	if cached := getCachedTokenInfo(token); cached != nil {
+		logger.Get().Printf("Token %s was issued by this helper", info.Fingerprint[:12])
+		info.ExpiresAt = &cached.ExpiresAt
+		info.Permissions = cached.Permissions
+		info.RepositorySelection = cached.RepositorySelection
+	}
+
+	rateLimits, err := client.GetRateLimit(ctx, token)
+	var apiErr *github.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized {
+		logger.Get().Printf("Token %s was rejected: %s", info.Fingerprint[:12], err)
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Valid = true
+	if core, ok := rateLimits.Resources["core"]; ok {
+		info.RateLimit = &core
+	}
+	if info.ExpiresAt == nil {
+		info.ExpiresAt = rateLimits.TokenExpiresAt
+	}
+
+	info.Repositories, err = client.GetInstallationRepositories(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// setCachedTokenInfo remembers the token response without the token, so that inspection can report it later.
+func setCachedTokenInfo(token *github.AppInstallationAccessToken) {
+	tokenInfo := *token
+	tokenInfo.Token = ""
+	ttl := time.Hour
+	if !token.ExpiresAt.IsZero() {
+		ttl = time.Until(token.ExpiresAt)
+	}
+	_ = cache.Set(tokenInfoCacheKey(token.Token), tokenInfo, ttl)
+}
+
+func getCachedTokenInfo(token string) *github.AppInstallationAccessToken {
+	tokenInfo := github.AppInstallationAccessToken{}
+	if hit, err := cache.Get(tokenInfoCacheKey(token), &tokenInfo); err != nil || !hit {
+		return nil
+	}
+	return &tokenInfo
+}
@@ -0,0 +1,58 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/plumber-cd/github-apps-trampoline/github"
+)
+
+// Installation types, matching target_type of the installation.
+const (
+	InstallationTypeEnterprise   = "enterprise"
+	InstallationTypeOrganization = "organization"
+	InstallationTypeUser         = "user"
+)
+
+func validateInstallationType(config *Config) error {
+	if config.InstallationType == nil {
+		return nil
+	}
+	switch *config.InstallationType {
+	case InstallationTypeEnterprise, InstallationTypeOrganization, InstallationTypeUser:
+		return nil
+	}
+	return fmt.Errorf(
+		"installation_type must be one of %s, %s or %s, got: %q",
+		InstallationTypeEnterprise, InstallationTypeOrganization, InstallationTypeUser, *config.InstallationType,
+	)
+}
+
+// installationType returns the configured installation type.
+// Installation paths like github.com/enterprises/acme imply the enterprise type.
+// Empty means any type.
+func installationType(config Config) string {
+	if config.InstallationType != nil {
+		return *config.InstallationType
+	}
+	if config.Installation != nil && isEnterprisePath(*config.Installation) {
+		return InstallationTypeEnterprise
+	}
+	return ""
+}
+
+// isEnterprisePath reports whether the installation path is of server/enterprises/slug form.
+func isEnterprisePath(installation string) bool {
+	split := strings.Split(installation, "/")
+	return len(split) == 3 && split[1] == "enterprises"
+}
+
+// matchesInstallation reports whether the installation belongs to the owner, which is an account login,
+// or a slug for enterprise accounts, compared case-insensitively as GitHub does. If installationType is set, the installation target type must match too.
+func matchesInstallation(installation github.AppInstallation, owner, installationType string) bool {
+	return matchesInstallationType(installation, installationType) && strings.EqualFold(installation.Account.Handle(), owner)
+}
+
+func matchesInstallationType(installation github.AppInstallation, installationType string) bool {
+	return installationType == "" || strings.EqualFold(installation.TargetType, installationType)
+}
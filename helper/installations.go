@@ -0,0 +1,115 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+func (h GitHelper) Installations(ctx context.Context) ([]github.AppInstallation, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
+	}
+
+	return listInstallations(ctx, h.config, h.jwts.get(h.config))
+}
+
+func (h CLIHelper) Installations(ctx context.Context) ([]github.AppInstallation, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
+	}
+
+	return listInstallations(ctx, h.config, h.jwts.get(h.config))
+}
+
+func (h GitHelper) InstallationRepositories(ctx context.Context, owner string) ([]github.Repository, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
+	}
+
+	return listInstallationRepositories(ctx, ownerConfig(h.config, owner), h.jwts.get(h.config))
+}
+
+func (h CLIHelper) InstallationRepositories(ctx context.Context, owner string) ([]github.Repository, error) {
+	if err := validateConfig(&h.config); err != nil {
+		return nil, err
+	}
+
+	return listInstallationRepositories(ctx, ownerConfig(h.config, owner), h.jwts.get(h.config))
+}
+
+func listInstallations(ctx context.Context, config Config, jwt *jwtSource) ([]github.AppInstallation, error) {
+	client, err := newClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return withClockSkewRetry(jwt, func(jwt *jwtSource) ([]github.AppInstallation, error) {
+		installations, _, err := getInstallationsWithCache(ctx, client, config, jwt)
+		return installations, err
+	})
+}
+
+func listInstallationRepositories(ctx context.Context, config Config, jwt *jwtSource) ([]github.Repository, error) {
+	client, err := newClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return withClockSkewRetry(jwt, func(jwt *jwtSource) ([]github.Repository, error) {
+		repositories, _, err := getInstallationRepositoriesWithCache(ctx, client, &config, jwt)
+		return repositories, err
+	})
+}
+
+// ownerConfig derives a config for the installation of the owner, on the same server and app as config.
+func ownerConfig(config Config, owner string) Config {
+	installation := fmt.Sprintf("%s/%s", *config.GitHubServer, owner)
+	ownerConfig := connectionConfig(config)
+	ownerConfig.Installation = &installation
+	return ownerConfig
+}
+
+// connectionConfig keeps only what identifies the app and how to reach GitHub API,
+// dropping everything a rule adds to shape its own token requests.
+func connectionConfig(config Config) Config {
+	return Config{
+		GitHubServer:       config.GitHubServer,
+		GitHubAPI:          config.GitHubAPI,
+		APIVersion:         config.APIVersion,
+		PrivateKey:         config.PrivateKey,
+		AppID:              config.AppID,
+		ClientID:           config.ClientID,
+		CAFile:             config.CAFile,
+		ClientCert:         config.ClientCert,
+		ClientKey:          config.ClientKey,
+		Proxy:              config.Proxy,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+}
+
+// discoveryToken requests a read-only token for all repositories in the installation, used to look around the installation.
+// The installation is resolved first if config doesn't have it already.
+func discoveryToken(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) (*github.AppInstallationAccessToken, error) {
+	return scopedDiscoveryToken(ctx, client, config, jwt, json.RawMessage(`{"metadata":"read"}`))
+}
+
+// scopedDiscoveryToken is like discoveryToken, but with the given permissions.
+func scopedDiscoveryToken(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource, permissions json.RawMessage) (*github.AppInstallationAccessToken, error) {
+	if err := validateInstallationID(ctx, client, config, jwt, ""); err != nil {
+		return nil, err
+	}
+
+	// Only the installation is kept, so nothing of the rule - including the cache key of its own token - leaks in.
+	discovery := connectionConfig(*config)
+	discovery.Installation = config.Installation
+	discovery.InstallationType = config.InstallationType
+	discovery.InstallationID = config.InstallationID
+	discovery.ResolvedOwner = config.ResolvedOwner
+	discovery.Permissions = &permissions
+	logger.Get().Printf("Requesting discovery token for installation %d", *discovery.InstallationID)
+	return getTokenWithRetry(ctx, client, &discovery, jwt, "")
+}
@@ -0,0 +1,129 @@
+package helper
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// jwtRefreshMargin is how long before its exp a signed JWT stops being reused.
+const jwtRefreshMargin = time.Minute
+
+// jwtSource mints an app JWT lazily on first use and reuses it until shortly before it expires.
+type jwtSource struct {
+	mu         sync.Mutex
+	privateKey string
+	issuer     string
+	api        string
+
+	clockSkew       time.Duration
+	clockSkewLoaded bool
+	token           string
+	expiresAt       time.Time
+}
+
+type jwtSources struct {
+	mu      sync.Mutex
+	sources map[string]*jwtSource
+}
+
+func newJWTSources() *jwtSources {
+	return &jwtSources{sources: map[string]*jwtSource{}}
+}
+
+// get returns a shared source for the key and issuer in config, which must have been validated already.
+func (s *jwtSources) get(config Config) *jwtSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("key=%s issuer=%s api=%s", config.PrivateKey, jwtIssuer(config), *config.GitHubAPI)
+	if source, ok := s.sources[key]; ok {
+		return source
+	}
+	source := &jwtSource{
+		privateKey: config.PrivateKey,
+		issuer:     jwtIssuer(config),
+		api:        *config.GitHubAPI,
+	}
+	s.sources[key] = source
+	return source
+}
+
+func (s *jwtSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Add(jwtRefreshMargin).Before(s.expiresAt) {
+		logger.Get().Printf("Reusing JWT valid until %s", s.expiresAt.UTC().Format(time.RFC3339))
+		return s.token, nil
+	}
+
+	if !s.clockSkewLoaded {
+		s.clockSkew = getCachedClockSkew(s.api)
+		s.clockSkewLoaded = true
+	}
+
+	opts := github.JWTOptions{
+		IssuedAtDrift:   *options.JWTIssuedAtDrift,
+		ExpirationDrift: *options.JWTExpirationDrift,
+		ClockSkew:       s.clockSkew,
+	}
+	token, err := github.CreateJWT(s.privateKey, s.issuer, opts)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.expiresAt = time.Now().Add(github.MaxJWTLifetime - opts.ExpirationDrift)
+	return s.token, nil
+}
+
+// correctClockSkew discards the current JWT so that the next one is minted with the given skew.
+func (s *jwtSource) correctClockSkew(clockSkew time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clockSkew = clockSkew
+	s.clockSkewLoaded = true
+	s.token = ""
+	setCachedClockSkew(s.api, clockSkew)
+}
+
+func withClockSkewRetry[T any](jwt *jwtSource, fn func(jwt *jwtSource) (T, error)) (T, error) {
+	result, err := fn(jwt)
+	if err == nil {
+		return result, nil
+	}
+	detected, ok := github.ClockSkew(err)
+	if !ok {
+		return result, err
+	}
+
+	logger.Get().Printf("JWT was rejected with clock skew of %s, retrying with corrected iat/exp", detected)
+	jwt.correctClockSkew(detected)
+	return fn(jwt)
+}
+
+func jwtIssuer(config Config) string {
+	if config.ClientID != "" {
+		return config.ClientID
+	}
+	return strconv.Itoa(config.AppID)
+}
+
+func getCachedClockSkew(api string) time.Duration {
+	var clockSkew time.Duration
+	if hit, err := cache.Get(clockSkewCacheKey(api), &clockSkew); err != nil || !hit {
+		return 0
+	}
+	logger.Get().Printf("Using cached clock skew of %s", clockSkew)
+	return clockSkew
+}
+
+func setCachedClockSkew(api string, clockSkew time.Duration) {
+	_ = cache.Set(clockSkewCacheKey(api), clockSkew, cache.TTLClockSkew())
+}
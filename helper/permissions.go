@@ -0,0 +1,274 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+const (
+	OnPermissionMismatchIgnore = "ignore"
+	OnPermissionMismatchWarn   = "warn"
+	OnPermissionMismatchFail   = "fail"
+)
+
+var permissionLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// PermissionMismatchError describes how a token differs from what was requested.
+type PermissionMismatchError struct {
+	// Downgraded maps a permission to "requested->granted".
+	Downgraded map[string]string
+
+	// Missing lists requested permissions that were not granted at all.
+	Missing []string
+
+	// MissingRepositories lists requested repositories (names or IDs) the token has no access to.
+	MissingRepositories []string
+}
+
+func (e *PermissionMismatchError) Error() string {
+	parts := permissionDiffParts(e.Downgraded, e.Missing)
+	if len(e.MissingRepositories) > 0 {
+		parts = append(parts, fmt.Sprintf("missing repositories [%s]", strings.Join(e.MissingRepositories, ", ")))
+	}
+	return fmt.Sprintf("Token granted differs from requested: %s", strings.Join(parts, "; "))
+}
+
+// InstallationPermissionsError describes requested permissions the installation itself does not have.
+type InstallationPermissionsError struct {
+	InstallationID int
+
+	// Downgraded maps a permission to "requested->available".
+	Downgraded map[string]string
+
+	// Missing lists requested permissions the installation does not have at all.
+	Missing []string
+}
+
+func (e *InstallationPermissionsError) Error() string {
+	return fmt.Sprintf(
+		"Requested permissions exceed what installation %d has: %s",
+		e.InstallationID,
+		strings.Join(permissionDiffParts(e.Downgraded, e.Missing), "; "),
+	)
+}
+
+func permissionDiffParts(downgraded map[string]string, missing []string) []string {
+	parts := []string{}
+	if len(downgraded) > 0 {
+		names := make([]string, 0, len(downgraded))
+		for name := range downgraded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, 0, len(names))
+		for _, name := range names {
+			pairs = append(pairs, fmt.Sprintf("%s:%s", name, downgraded[name]))
+		}
+		parts = append(parts, fmt.Sprintf("downgraded permissions [%s]", strings.Join(pairs, ", ")))
+	}
+	if len(missing) > 0 {
+		parts = append(parts, fmt.Sprintf("missing permissions [%s]", strings.Join(missing, ", ")))
+	}
+	return parts
+}
+
+// diffPermissions returns requested permissions granted at a lower level and those not granted at all.
+func diffPermissions(requested, granted map[string]string) (map[string]string, []string) {
+	downgraded := map[string]string{}
+	missing := []string{}
+	for name, level := range requested {
+		available, ok := granted[name]
+		if !ok {
+			missing = append(missing, name)
+		} else if permissionLevels[available] < permissionLevels[level] {
+			downgraded[name] = fmt.Sprintf("%s->%s", level, available)
+		}
+	}
+	sort.Strings(missing)
+	return downgraded, missing
+}
+
+func requestedPermissions(config Config) (map[string]string, error) {
+	requested := map[string]string{}
+	if config.Permissions == nil {
+		return requested, nil
+	}
+	if err := json.Unmarshal(*config.Permissions, &requested); err != nil {
+		return nil, err
+	}
+	return requested, nil
+}
+
+// checkPermissions compares the token against the request according to config.OnPermissionMismatch.
+// A token that fails the check is revoked, so it is neither served from cache nor left valid.
+func checkPermissions(ctx context.Context, config Config, token *github.AppInstallationAccessToken) error {
+	mode := OnPermissionMismatchIgnore
+	if config.OnPermissionMismatch != nil {
+		mode = *config.OnPermissionMismatch
+	}
+	if mode == OnPermissionMismatchIgnore {
+		return nil
+	}
+
+	mismatch, err := comparePermissions(config, token)
+	if err != nil {
+		return err
+	}
+	if mismatch == nil {
+		return nil
+	}
+
+	if mode == OnPermissionMismatchWarn {
+		logger.Warnf("%s", mismatch)
+		return nil
+	}
+
+	if _, err := evictToken(token.Token); err != nil {
+		logger.Get().Printf("Failed to evict mismatched token: %s", err)
+	}
+	if err := revokeToken(ctx, config, token.Token); err != nil {
+		logger.Get().Printf("Failed to revoke mismatched token: %s", err)
+	}
+	return mismatch
+}
+
+func comparePermissions(config Config, token *github.AppInstallationAccessToken) (*PermissionMismatchError, error) {
+	requested, err := requestedPermissions(config)
+	if err != nil {
+		return nil, err
+	}
+	mismatch := &PermissionMismatchError{}
+	mismatch.Downgraded, mismatch.Missing = diffPermissions(requested, token.Permissions)
+
+	if token.RepositorySelection == "selected" {
+		names := map[string]bool{}
+		ids := map[int]bool{}
+		for _, repo := range token.Repositories {
+			names[strings.ToLower(repo.Name)] = true
+			ids[repo.ID] = true
+		}
+		if config.Repositories != nil {
+			for _, repo := range *config.Repositories {
+				if !names[strings.ToLower(repo)] {
+					mismatch.MissingRepositories = append(mismatch.MissingRepositories, repo)
+				}
+			}
+		}
+		if config.RepositoryIDs != nil {
+			for _, id := range *config.RepositoryIDs {
+				if !ids[id] {
+					mismatch.MissingRepositories = append(mismatch.MissingRepositories, fmt.Sprintf("%d", id))
+				}
+			}
+		}
+	}
+
+	if len(mismatch.Downgraded) == 0 && len(mismatch.Missing) == 0 && len(mismatch.MissingRepositories) == 0 {
+		return nil, nil
+	}
+	return mismatch, nil
+}
+
+// preflightPermissions checks the request against permissions of the installation before asking for a token.
+// With ClampPermissions the request is reduced to what the installation has, otherwise a diff is returned as an error.
+// Requested repositories the installation has no access to are always an error.
+func preflightPermissions(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) error {
+	clamp := config.ClampPermissions != nil && *config.ClampPermissions
+	if !clamp && (config.Preflight == nil || !*config.Preflight) {
+		return nil
+	}
+
+	installation, err := getInstallationWithCache(ctx, client, config, jwt)
+	if err != nil {
+		return err
+	}
+	if err := checkSuspended(installation); err != nil {
+		return err
+	}
+	logger.Get().Printf(
+		"Preflight: installation %d for %s has repository_selection=%s permissions=%v",
+		installation.ID, installation.Account.Handle(), installation.RepositorySelection, installation.Permissions,
+	)
+
+	// Only some repositories are accessible to the installation - check the requested ones are among them,
+	// unless resolve_repositories already did.
+	resolved := config.ResolveRepositories != nil && *config.ResolveRepositories
+	if installation.RepositorySelection == "selected" && !resolved && (config.Repositories != nil || config.RepositoryIDs != nil) {
+		if _, err := accessibleRepositories(ctx, client, config, jwt); err != nil {
+			return err
+		}
+	}
+
+	// Clamp the permissions as configured, not the result of an earlier clamp against another installation.
+	if config.RequestedPermissions == nil {
+		config.RequestedPermissions = config.Permissions
+	}
+	requested, err := requestedPermissions(Config{Permissions: config.RequestedPermissions})
+	if err != nil {
+		return err
+	}
+	downgraded, missing := diffPermissions(requested, installation.Permissions)
+	if len(downgraded) == 0 && len(missing) == 0 {
+		config.Permissions = config.RequestedPermissions
+		return nil
+	}
+
+	// Clamping only lowers levels - dropping a permission could leave an empty request,
+	// which GitHub treats as every permission the installation has.
+	if !clamp || len(missing) > 0 {
+		return &InstallationPermissionsError{InstallationID: installation.ID, Downgraded: downgraded, Missing: missing}
+	}
+
+	clamped := map[string]string{}
+	for name, level := range requested {
+		if available, ok := installation.Permissions[name]; ok {
+			if permissionLevels[available] < permissionLevels[level] {
+				level = available
+			}
+			clamped[name] = level
+		}
+	}
+	if len(clamped) == 0 {
+		return &InstallationPermissionsError{InstallationID: installation.ID, Downgraded: downgraded, Missing: missing}
+	}
+	logger.Get().Printf("Preflight: clamping permissions %v to %v", requested, clamped)
+	raw, err := json.Marshal(clamped)
+	if err != nil {
+		return err
+	}
+	clampedRaw := json.RawMessage(raw)
+	config.Permissions = &clampedRaw
+	return nil
+}
+
+func getInstallationWithCache(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) (*github.AppInstallation, error) {
+	key := installationCacheKey(appCacheKey(*config), *config.GitHubAPI, *config.InstallationID)
+	installation := github.AppInstallation{}
+	if hit, err := cache.Get(key, &installation); err != nil {
+		return nil, err
+	} else if hit && installation.ID != 0 {
+		return &installation, nil
+	}
+
+	signed, err := jwt.Token()
+	if err != nil {
+		return nil, err
+	}
+	fetched, err := client.GetInstallation(ctx, signed, *config.InstallationID)
+	if err != nil {
+		return nil, err
+	}
+	_ = cache.Set(key, fetched, cache.TTLInstallations())
+	return fetched, nil
+}
@@ -0,0 +1,167 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// RepositoriesNotAccessibleError lists requested repositories that the installation has no access to.
+type RepositoriesNotAccessibleError struct {
+	InstallationID int
+	Repositories   []string
+}
+
+func (e *RepositoriesNotAccessibleError) Error() string {
+	return fmt.Sprintf(
+		"Repositories are not accessible to installation %d: %s",
+		e.InstallationID, strings.Join(e.Repositories, ", "),
+	)
+}
+
+// prepareRepositories normalizes owner/repo entries in Repositories and, with ResolveRepositories,
+// resolves names to IDs and checks that every requested repository is accessible to the installation.
+func prepareRepositories(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) error {
+	if config.Repositories != nil {
+		if err := stripRepositoryOwners(ctx, client, config, jwt); err != nil {
+			return err
+		}
+	}
+
+	if config.ResolveRepositories == nil || !*config.ResolveRepositories {
+		return nil
+	}
+	if config.Repositories == nil && config.RepositoryIDs == nil {
+		return nil
+	}
+
+	ids, err := accessibleRepositories(ctx, client, config, jwt)
+	if err != nil {
+		return err
+	}
+
+	logger.Get().Printf("Resolved repositories=%v repository_ids=%v to repository_ids=%v", config.Repositories, config.RepositoryIDs, ids)
+	config.Repositories = nil
+	config.RepositoryIDs = &ids
+	return nil
+}
+
+// accessibleRepositories returns IDs of the requested repositories,
+// or a RepositoriesNotAccessibleError if any of them is not accessible to the installation.
+func accessibleRepositories(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) ([]int, error) {
+	repositories, fromCache, err := getInstallationRepositoriesWithCache(ctx, client, config, jwt)
+	if err != nil {
+		return nil, err
+	}
+	ids, missing := resolveRepositories(*config, repositories)
+	if len(missing) > 0 && fromCache {
+		logger.Get().Printf("Repositories %v not found in cached list, refreshing", missing)
+		cache.Delete(installationRepositoriesCacheKey(appCacheKey(*config), *config.GitHubAPI, *config.InstallationID))
+		if repositories, _, err = getInstallationRepositoriesWithCache(ctx, client, config, jwt); err != nil {
+			return nil, err
+		}
+		ids, missing = resolveRepositories(*config, repositories)
+	}
+	if len(missing) > 0 {
+		return nil, &RepositoriesNotAccessibleError{InstallationID: *config.InstallationID, Repositories: missing}
+	}
+	return ids, nil
+}
+
+// resolveRepositories maps requested repository names and IDs to IDs of repositories accessible to the installation.
+// Requested repositories that are not accessible are returned as missing.
+func resolveRepositories(config Config, repositories []github.Repository) ([]int, []string) {
+	byName := map[string]int{}
+	byID := map[int]bool{}
+	for _, repository := range repositories {
+		byName[strings.ToLower(repository.Name)] = repository.ID
+		byID[repository.ID] = true
+	}
+
+	ids := []int{}
+	seen := map[int]bool{}
+	missing := []string{}
+	add := func(id int) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if config.Repositories != nil {
+		for _, name := range *config.Repositories {
+			if id, ok := byName[strings.ToLower(name)]; ok {
+				add(id)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+	}
+	if config.RepositoryIDs != nil {
+		for _, id := range *config.RepositoryIDs {
+			if byID[id] {
+				add(id)
+			} else {
+				missing = append(missing, fmt.Sprintf("%d", id))
+			}
+		}
+	}
+	return ids, missing
+}
+
+// stripRepositoryOwners turns owner/repo entries in Repositories into plain names, as expected by GitHub,
+// after checking that the owner is the owner of the installation.
+func stripRepositoryOwners(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) error {
+	owner := config.ResolvedOwner
+	names := []string{}
+	for _, repository := range *config.Repositories {
+		repoOwner, name, ok := strings.Cut(repository, "/")
+		if !ok {
+			names = append(names, repository)
+			continue
+		}
+		if owner == "" {
+			installation, err := getInstallationWithCache(ctx, client, config, jwt)
+			if err != nil {
+				return err
+			}
+			owner = installation.Account.Handle()
+		}
+		if !strings.EqualFold(repoOwner, owner) {
+			return fmt.Errorf("Repository %s does not belong to %s, the owner of installation %d", repository, owner, *config.InstallationID)
+		}
+		names = append(names, name)
+	}
+	config.Repositories = &names
+	return nil
+}
+
+// getInstallationRepositoriesWithCache lists repositories accessible to the installation using a discovery token.
+// Also returns whether the list came from cache.
+func getInstallationRepositoriesWithCache(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) ([]github.Repository, bool, error) {
+	if err := validateInstallationID(ctx, client, config, jwt, ""); err != nil {
+		return nil, false, err
+	}
+
+	key := installationRepositoriesCacheKey(appCacheKey(*config), *config.GitHubAPI, *config.InstallationID)
+	repositories := []github.Repository{}
+	if hit, err := cache.Get(key, &repositories); err != nil {
+		return nil, false, err
+	} else if hit {
+		return repositories, true, nil
+	}
+
+	token, err := discoveryToken(ctx, client, config, jwt)
+	if err != nil {
+		return nil, false, err
+	}
+	repositories, err = client.GetInstallationRepositories(ctx, token.Token)
+	if err != nil {
+		return nil, false, err
+	}
+	_ = cache.Set(key, repositories, cache.TTLInstallations())
+	return repositories, false, nil
+}
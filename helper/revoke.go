@@ -0,0 +1,121 @@
+package helper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// revokedTTL is how long a revoked token is remembered - installation tokens never live longer.
+const revokedTTL = time.Hour
+
+// Fingerprint is a SHA-256 of the token that is safe to log.
+func Fingerprint(token string) string {
+	fp := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(fp[:])
+}
+
+func revokeToken(ctx context.Context, config Config, token string) error {
+	client, err := newClient(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	logger.Get().Printf("Revoking token %s", Fingerprint(token)[:12])
+	err = client.RevokeToken(ctx, token)
+	var apiErr *github.APIError
+	if err != nil && errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized {
+		logger.Get().Printf("Token %s is already invalid", Fingerprint(token)[:12])
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	markTokenRevoked(token)
+	return nil
+}
+
+// evictToken drops the token from cache and reports whether it was there.
+// Other processes may still hold it, so it is left valid.
+func evictToken(token string) (bool, error) {
+	if !cache.Enabled() {
+		return false, nil
+	}
+
+	indexKey := tokenIndexCacheKey(token)
+	var tokenKey string
+	if hit, err := cache.Get(indexKey, &tokenKey); err != nil {
+		return false, err
+	} else if !hit || tokenKey == "" {
+		logger.Get().Printf("Token %s is not cached", Fingerprint(token)[:12])
+		return false, nil
+	}
+
+	var cachedToken github.AppInstallationAccessToken
+	if hit, err := cache.Get(tokenKey, &cachedToken); err != nil {
+		return false, err
+	} else if hit && cachedToken.Token == token {
+		logger.Get().Printf("Evicting token %s from cache", Fingerprint(token)[:12])
+		cache.Delete(tokenKey)
+	}
+	cache.Delete(indexKey)
+	return true, nil
+}
+
+// cachedToken looks up a token in cache the same way GetToken would, but never calls GitHub API.
+// GetToken may augment repositories and permissions before caching, so the rule is looked up first.
+func cachedToken(config *Config, currentRepo string) (*github.AppInstallationAccessToken, error) {
+	if !cache.Enabled() {
+		return nil, nil
+	}
+
+	if config.InstallationID == nil {
+		owner, _, err := installationOwner(config, currentRepo)
+		if err != nil {
+			return nil, err
+		}
+		cachedID, ok, err := getCachedInstallationID(config, owner)
+		if err != nil || !ok {
+			return nil, err
+		}
+		config.InstallationID = &cachedID
+	}
+
+	rule := *config
+	rule.Rule = config
+	ruleKey, err := ruleTokenCacheKey(rule)
+	if err != nil {
+		return nil, err
+	}
+	var tokenKey string
+	if hit, err := cache.Get(ruleKey, &tokenKey); err != nil {
+		return nil, err
+	} else if hit && tokenKey != "" {
+		return getCachedToken(tokenKey)
+	}
+
+	// Nothing was augmented for the request - the token is cached under the rule itself.
+	requestData, err := tokenRequest(*config)
+	if err != nil {
+		return nil, err
+	}
+	return getCachedToken(tokenCacheKey(*config, requestData))
+}
+
+func markTokenRevoked(token string) {
+	_ = cache.Set(revokedCacheKey(token), true, revokedTTL)
+}
+
+func isTokenRevoked(token string) bool {
+	var revoked bool
+	hit, err := cache.Get(revokedCacheKey(token), &revoked)
+	return err == nil && hit && revoked
+}
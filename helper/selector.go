@@ -0,0 +1,188 @@
+package helper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/plumber-cd/github-apps-trampoline/cache"
+	"github.com/plumber-cd/github-apps-trampoline/github"
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// RepositorySelector selects repositories of the installation dynamically.
+// A repository is selected if it matches any of the criteria that are set.
+type RepositorySelector struct {
+	// Name is a regular expression matched against repository names.
+	Name string `json:"name,omitempty"`
+
+	// Topics selects repositories having any of these topics.
+	Topics []string `json:"topics,omitempty"`
+
+	// Property selects repositories by a custom property value.
+	// Requires the app to have organization_custom_properties read permission.
+	Property *RepositoryPropertySelector `json:"property,omitempty"`
+}
+
+type RepositoryPropertySelector struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func validateRepositorySelector(config *Config) error {
+	selector := config.RepositorySelector
+	if selector == nil {
+		return nil
+	}
+	if selector.Name == "" && len(selector.Topics) == 0 && selector.Property == nil {
+		return fmt.Errorf("repository_selector must set at least one of name, topics or property")
+	}
+	if selector.Name != "" {
+		if _, err := regexp.Compile(selector.Name); err != nil {
+			return fmt.Errorf("repository_selector name is not a valid regular expression: %w", err)
+		}
+	}
+	if selector.Property != nil && selector.Property.Name == "" {
+		return fmt.Errorf("repository_selector property must have a name")
+	}
+	if config.CurrentRepositoryOnly != nil && *config.CurrentRepositoryOnly {
+		return fmt.Errorf("repository_selector conflicts with current_repo")
+	}
+	if config.CurrentOwnerOnly != nil && *config.CurrentOwnerOnly {
+		return fmt.Errorf("repository_selector conflicts with current_owner")
+	}
+	return nil
+}
+
+// selectRepositories adds repositories matched by RepositorySelector to Repositories.
+// It is an error if nothing matched, as an empty list would otherwise request access to all repositories.
+func selectRepositories(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) error {
+	if config.RepositorySelector == nil {
+		return nil
+	}
+
+	if err := validateInstallationID(ctx, client, config, jwt, ""); err != nil {
+		return err
+	}
+
+	repositories, _, err := getInstallationRepositoriesWithCache(ctx, client, config, jwt)
+	if err != nil {
+		return err
+	}
+
+	// The selection is cached for the listing it was made from, so it is redone whenever the listing is refreshed.
+	key, err := repositorySelectorCacheKey(*config, *config.GitHubAPI, repositories)
+	if err != nil {
+		return err
+	}
+	selected := []string{}
+	if hit, err := cache.Get(key, &selected); err != nil {
+		return err
+	} else if !hit {
+		if selected, err = matchRepositorySelector(ctx, client, config, jwt, repositories); err != nil {
+			return err
+		}
+		_ = cache.Set(key, selected, cache.TTLInstallations())
+	}
+
+	if len(selected) == 0 {
+		return fmt.Errorf("repository_selector did not match any repositories of installation %d", *config.InstallationID)
+	}
+	logger.Get().Printf("repository_selector matched %v", selected)
+
+	names := []string{}
+	if config.Repositories != nil {
+		names = append(names, *config.Repositories...)
+	}
+	for _, name := range selected {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	config.Repositories = &names
+	return nil
+}
+
+func matchRepositorySelector(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource, repositories []github.Repository) ([]string, error) {
+	selector := config.RepositorySelector
+
+	byProperty := map[int]bool{}
+	if selector.Property != nil {
+		var err error
+		if byProperty, err = repositoriesByProperty(ctx, client, config, jwt); err != nil {
+			return nil, err
+		}
+	}
+
+	var name *regexp.Regexp
+	if selector.Name != "" {
+		name = regexp.MustCompile(selector.Name)
+	}
+
+	selected := []string{}
+	for _, repository := range repositories {
+		matched := name != nil && name.MatchString(repository.Name)
+		for _, topic := range selector.Topics {
+			matched = matched || slices.Contains(repository.Topics, topic)
+		}
+		matched = matched || byProperty[repository.ID]
+		if matched {
+			selected = append(selected, repository.Name)
+		}
+	}
+	return selected, nil
+}
+
+// repositoriesByProperty returns IDs of repositories in the installation owner organization
+// that have the custom property value requested by the selector.
+func repositoriesByProperty(ctx context.Context, client *github.Client, config *Config, jwt *jwtSource) (map[int]bool, error) {
+	property := config.RepositorySelector.Property
+
+	installation, err := getInstallationWithCache(ctx, client, config, jwt)
+	if err != nil {
+		return nil, err
+	}
+	if installation.Account.Type != "" && installation.Account.Type != "Organization" {
+		return nil, fmt.Errorf("repository_selector property requires an organization installation, %s is a %s", installation.Account.Handle(), installation.Account.Type)
+	}
+
+	token, err := scopedDiscoveryToken(ctx, client, config, jwt, json.RawMessage(`{"metadata":"read","organization_custom_properties":"read"}`))
+	if err != nil {
+		return nil, err
+	}
+	values, err := client.GetRepositoryPropertyValues(ctx, token.Token, installation.Account.Handle())
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[int]bool{}
+	for _, repository := range values {
+		for _, value := range repository.Properties {
+			if value.PropertyName == property.Name && value.Matches(property.Value) {
+				matched[repository.RepositoryID] = true
+			}
+		}
+	}
+	return matched, nil
+}
+
+func repositorySelectorCacheKey(config Config, api string, repositories []github.Repository) (string, error) {
+	raw, err := json.Marshal(config.RepositorySelector)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	listing, err := json.Marshal(repositories)
+	if err != nil {
+		return "", err
+	}
+	listingSum := sha256.Sum256(listing)
+	return fmt.Sprintf(
+		"repository_selector:%s api=%s id=%d selector=%s repositories=%s",
+		appCacheKey(config), api, *config.InstallationID, hex.EncodeToString(sum[:]), hex.EncodeToString(listingSum[:]),
+	), nil
+}
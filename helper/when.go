@@ -0,0 +1,118 @@
+package helper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/plumber-cd/github-apps-trampoline/logger"
+)
+
+// When is a set of conditions on the environment the helper runs in.
+// A rule is only considered matched if all conditions that are set hold.
+type When struct {
+	// Env requires environment variables to be set to exactly these values.
+	Env map[string]string `json:"env,omitempty"`
+
+	// EnvMatch requires environment variables to match these regular expressions.
+	// Unset variables are matched as empty strings.
+	EnvMatch map[string]string `json:"env_match,omitempty"`
+
+	// CwdPrefix requires the current working directory to be one of these paths or under it.
+	// A leading ~ is expanded to the home directory.
+	CwdPrefix []string `json:"cwd_prefix,omitempty"`
+
+	// Hostname requires the hostname of the machine to be one of these.
+	Hostname []string `json:"hostname,omitempty"`
+
+	envMatch map[string]*regexp.Regexp
+}
+
+// compile compiles EnvMatch patterns once, so an invalid pattern is reported as soon as the rule is validated.
+func (w *When) compile() error {
+	if w == nil || w.envMatch != nil {
+		return nil
+	}
+	compiled := make(map[string]*regexp.Regexp, len(w.EnvMatch))
+	for name, pattern := range w.EnvMatch {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("when env_match %s is not a valid regular expression: %w", name, err)
+		}
+		compiled[name] = re
+	}
+	w.envMatch = compiled
+	return nil
+}
+
+// Matches evaluates the conditions, logging the first one that doesn't hold.
+func (w *When) Matches() (bool, error) {
+	if w == nil {
+		return true, nil
+	}
+	if err := w.compile(); err != nil {
+		return false, err
+	}
+
+	for name, expected := range w.Env {
+		if value, ok := os.LookupEnv(name); !ok || value != expected {
+			logger.Get().Printf("Condition env %s=%q not met", name, expected)
+			return false, nil
+		}
+	}
+
+	for name, re := range w.envMatch {
+		if !re.MatchString(os.Getenv(name)) {
+			logger.Get().Printf("Condition env_match %s=%q not met", name, re)
+			return false, nil
+		}
+	}
+
+	if len(w.CwdPrefix) > 0 {
+		matched, err := cwdHasPrefix(w.CwdPrefix)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			logger.Get().Printf("Condition cwd_prefix %v not met", w.CwdPrefix)
+			return false, nil
+		}
+	}
+
+	if len(w.Hostname) > 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return false, err
+		}
+		if !slices.Contains(w.Hostname, hostname) {
+			logger.Get().Printf("Condition hostname %v not met by %q", w.Hostname, hostname)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func cwdHasPrefix(prefixes []string) (bool, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return false, err
+	}
+	for _, prefix := range prefixes {
+		if prefix == "~" || strings.HasPrefix(prefix, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return false, err
+			}
+			prefix = filepath.Join(home, strings.TrimPrefix(prefix, "~"))
+		}
+		prefix = filepath.Clean(prefix)
+		if cwd == prefix || strings.HasPrefix(cwd, prefix+string(filepath.Separator)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -94,3 +94,10 @@ func Filef(format string, args ...interface{}) {
 func Stderrf(format string, args ...interface{}) {
 	StderrRedacted().Printf(format, args...)
 }
+
+// Warnf logs a warning that is always shown on stderr, regardless of verbosity.
+func Warnf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	File().Printf("WARNING: %s", message)
+	fmt.Fprintf(os.Stderr, "github-apps-trampoline: WARNING: %s\n", message)
+}